@@ -31,7 +31,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"runtime"
 )
 
 // AbsIndex converts the given index into an absolute index.
@@ -54,7 +53,7 @@ func (l *State) Pop(n int) {
 // it is converted to a userdata value before being pushed.
 func (l *State) Push(v interface{}) {
 	switch x := v.(type) {
-	case nil, bool, string, float64, int64, *table, *function, *userdata:
+	case nil, bool, string, float64, int64, *table, *function, *userdata, *coroutine:
 	case float32:
 		v = float64(x)
 	case int:
@@ -184,6 +183,7 @@ func (l *State) Set(d, s int) {
 
 // SetGlobal pops a value from the stack and sets it as the new value of global name.
 func (l *State) SetGlobal(name string) {
+	l.checkLock()
 	l.global.Set(name, l.stack.Get(-1))
 	l.stack.Pop(1)
 }
@@ -206,6 +206,7 @@ func (l *State) SetUpValue(f, i, v int) bool {
 
 // Preload adds the given loader function for "require".
 func (l *State) Preload(name string, loader func(*State) int) {
+	l.checkLock()
 	loaded, ok := l.registry.Get("_PRELOAD").(*table)
 	if !ok {
 		loaded = newTable(l, 0, 16)
@@ -237,11 +238,14 @@ func (l *State) ToBoolean(i int) bool {
 }
 
 // ToString reads a value from the stack at the given index and formats it as a string.
-// This will call a __tostring metamethod if provided.
+// This will call a __tostring metamethod if provided, otherwise tables and userdata are named after the __name field of their meta table.
 // This is safe if no metamethods are called, but may panic if the metamethod errors out.
 func (l *State) ToString(i int) string {
 	v := l.get(i)
 	if m := l.getMetaField(v, "__tostring"); m == nil {
+		if name := l.typeName(v); name != typeOf(v).String() {
+			return name + ": " + pointerString(v)
+		}
 		return toString(v)
 	} else {
 		l.Push(m)
@@ -275,37 +279,38 @@ func (l *State) TryInteger(i int) (int64, error) {
 	return tryInteger(l.get(i))
 }
 
-// OptString is the same as ToString, except the given default is returned if the value is nil or non-existent.
+// OptString is the same as CheckString, except the given default is returned if the value is nil or non-existent.
 func (l *State) OptString(i int, d string) string {
 	if l.IsNil(i) {
 		return d
-	} else {
-		return l.ToString(i)
 	}
+	return l.CheckString(i)
 }
 
-// OptFloat is the same as ToFloat, except the given default is returned if the value is nil or non-existent.
+// OptFloat is the same as CheckNumber, except the given default is returned if the value is nil or non-existent.
 func (l *State) OptFloat(i int, d float64) float64 {
-	if v := l.get(i); v == nil {
+	if l.IsNil(i) {
 		return d
-	} else {
-		return toFloat(v)
 	}
+	return l.CheckNumber(i)
 }
 
-// OptInteger is the same as ToInt, except the given default is returned if the value is nil or non-existent.
+// OptInteger is the same as CheckInteger, except the given default is returned if the value is nil or non-existent.
 func (l *State) OptInteger(i int, d int64) int64 {
-	if v := l.get(i); v == nil {
+	if l.IsNil(i) {
 		return d
-	} else {
-		return toInteger(v)
 	}
+	return l.CheckInteger(i)
 }
 
 // Arith performs the specified the arithmetic operator with the top two items on the stack (or just the top item for OpUMinus and OpBinNot).
 // The result is pushed onto the stack.
 // This may raise an error if they values are not appropriate for the given operator.
 func (l *State) Arith(op opCode) {
+	l.Lock()
+	defer l.Unlock()
+	l = l.inner
+
 	a := l.stack.Get(-2)
 	b := a
 	if op != OpUMinus && op != OpBinNot {
@@ -318,6 +323,10 @@ func (l *State) Arith(op opCode) {
 // Compare performs the specified the comparison operator with the items at the given stack indexes.
 // This may raise an error if they values are not appropriate for the given operator.
 func (l *State) Compare(i1, i2 int, op opCode) bool {
+	l.Lock()
+	defer l.Unlock()
+	l = l.inner
+
 	a := l.get(i1)
 	b := l.get(i2)
 	return l.compare(op, a, b, false)
@@ -325,6 +334,7 @@ func (l *State) Compare(i1, i2 int, op opCode) bool {
 
 // CompareRaw is exactly like Compare, but without meta-methods.
 func (l *State) CompareRaw(i1, i2 int, op opCode) bool {
+	l.checkLock()
 	a := l.get(i1)
 	b := l.get(i2)
 	return l.compare(op, a, b, true)
@@ -332,6 +342,7 @@ func (l *State) CompareRaw(i1, i2 int, op opCode) bool {
 
 // NewTable creates a new table with "as" preallocated array elements and "hs" preallocated hash elements.
 func (l *State) NewTable(as, hs int) {
+	l.checkLock()
 	l.stack.Push(newTable(l, as, hs))
 }
 
@@ -339,6 +350,7 @@ func (l *State) NewTable(as, hs int) {
 // The type of the pushed object is returned.
 // This may raise an error if the value is not a table or is lacking the __index meta method.
 func (l *State) GetTable(i int) TypeID {
+	l.checkLock()
 	v := l.getTable(l.get(i), l.stack.Get(-1))
 	l.Pop(1)
 	l.Push(v)
@@ -348,6 +360,7 @@ func (l *State) GetTable(i int) TypeID {
 // GetTableRaw is like GetTable except it ignores meta methods.
 // This may raise an error if the value is not a table.
 func (l *State) GetTableRaw(i int) TypeID {
+	l.checkLock()
 	x := l.get(i)
 	k := l.stack.Get(-1)
 	l.Pop(1)
@@ -364,6 +377,7 @@ func (l *State) GetTableRaw(i int) TypeID {
 // This may raise an error if the value is not a table or is lacking the __newindex meta method.
 // The value must be on TOS, the key TOS-1.
 func (l *State) SetTable(i int) {
+	l.checkLock()
 	l.setTable(l.get(i), l.stack.Get(-2), l.stack.Get(-1))
 	l.Pop(2)
 }
@@ -371,6 +385,7 @@ func (l *State) SetTable(i int) {
 // SetTableRaw is like SetTable except it ignores meta methods.
 // This may raise an error if the value is not a table.
 func (l *State) SetTableRaw(i int) {
+	l.checkLock()
 	x := l.get(i)
 	k := l.stack.Get(-2)
 	v := l.stack.Get(-1)
@@ -385,6 +400,7 @@ func (l *State) SetTableRaw(i int) {
 // GetIter pushes a table iterator onto the stack.
 // If the given value is not a table this will raise an error.
 func (l *State) GetIter(i int) {
+	l.checkLock()
 	x := l.get(i)
 	if t, ok := x.(*table); ok {
 		next := t.GetIter()
@@ -399,6 +415,31 @@ func (l *State) GetIter(i int) {
 	}
 }
 
+// Next pops a key from the stack and pushes the key and the value of the next entry of the table at the given index,
+// like the next function. If there are no more entries it pushes nothing and returns false.
+// Use nil as the key to start a traversal. The key may be any key of the table, so a traversal can be continued later.
+// It raises an error if the value is not a table or the key is not in the table.
+// Assigning to existing fields during a traversal is allowed, adding new keys is not (see the next function).
+func (l *State) Next(i int) bool {
+	l.checkLock()
+	x := l.get(i)
+	t, ok := x.(*table)
+	if !ok {
+		panic(errors.New("not a table: " + toString(x)))
+	}
+	k, v, ok := t.Next(l.stack.Get(-1))
+	l.Pop(1)
+	if !ok {
+		panic(errors.New("invalid key to 'next'"))
+	}
+	if k == nil {
+		return false
+	}
+	l.Push(k)
+	l.Push(v)
+	return true
+}
+
 // ForEach is a fancy version of ForEachRaw that respects metamethods (to be specific, __pairs).
 func (l *State) ForEach(t int, f func() bool) {
 	t = l.AbsIndex(t)
@@ -450,6 +491,7 @@ func (l *State) ForEachRaw(t int, f func() bool) {
 // Returns the "length" of the item at the given index, exactly like the "#" operator would.
 // If this calls a meta method it may raise an error if the length is not an integer.
 func (l *State) Length(i int) int {
+	l.checkLock()
 	v := l.get(i)
 	if s, ok := v.(string); ok {
 		return len(s)
@@ -473,6 +515,7 @@ func (l *State) Length(i int) int {
 
 // Count returns the raw table pairs number.
 func (l *State) Count(i int) int {
+	l.checkLock()
 	v := l.get(i)
 	if t, ok := v.(*table); ok {
 		return t.Count()
@@ -484,6 +527,7 @@ func (l *State) Count(i int) int {
 // Returns the length of the table or string at the given index. This does not call meta methods.
 // If the value is not a table or string this will raise an error.
 func (l *State) LengthRaw(i int) int {
+	l.checkLock()
 	v := l.get(i)
 	if s, ok := v.(string); ok {
 		return len(s)
@@ -497,6 +541,7 @@ func (l *State) LengthRaw(i int) int {
 // GetMetaField pushes the meta method with the given name for the item at the given index onto the stack, then returns the type of the pushed item.
 // If the item does not have a meta table or does not have the specified method this does nothing and returns TypNil.
 func (l *State) GetMetaField(i int, name string) TypeID {
+	l.checkLock()
 	m := l.getMetaField(l.get(i), name)
 	if m != nil {
 		l.Push(m)
@@ -507,6 +552,7 @@ func (l *State) GetMetaField(i int, name string) TypeID {
 // GetMetaTable gets the meta table for the value at the given index and pushes it onto the stack.
 // If the value does not have a meta table then this returns false and pushes nothing.
 func (l *State) GetMetaTable(i int) bool {
+	l.checkLock()
 	if m := l.getMetaTable(l.get(i)); m == nil {
 		return false
 	} else {
@@ -518,7 +564,9 @@ func (l *State) GetMetaTable(i int) bool {
 // SetMetaTable pops a table from the stack and sets it as the meta table of the value at the given index.
 // If the value is not a userdata or table then the meta table is set for ALL values of that type!
 // If you try to set a metatable that is not a table or try to pass an invalid type this will raise an error.
+// A meta table with a __gc meta method makes the userdata or table finalizable, see RunFinalizers.
 func (l *State) SetMetaTable(i int) {
+	l.checkLock()
 	x := l.get(i)
 	t := l.stack.Get(-1)
 	m, ok := t.(*table)
@@ -528,9 +576,11 @@ func (l *State) SetMetaTable(i int) {
 	}
 	switch v := x.(type) {
 	case *table:
-		v.meta = m
+		v.setMeta(m)
+		l.setFinalizer(v, m)
 	case *userdata:
 		v.meta = m
+		l.setFinalizer(v, m)
 	case nil:
 		l.meta[TypeNil] = m
 	case float64:
@@ -543,6 +593,8 @@ func (l *State) SetMetaTable(i int) {
 		l.meta[TypeBoolean] = m
 	case *function:
 		l.meta[TypeFunction] = m
+	case *coroutine:
+		l.meta[TypeThread] = m
 	default:
 		panic(errors.New("unknown type: " + toString(x)))
 	}
@@ -566,19 +618,16 @@ func (l *State) Dump(i int, strip bool) []byte {
 
 // LoadBinary loads a binary chunk into memory and pushes the result onto the stack.
 // If there is an error it is returned and nothing is pushed.
-// Set env to 0 to use the default environment.
+// Set env to 0 to use the default environment, or to the index of a table or of nil.
 func (l *State) LoadBinary(in io.Reader, name string, env int) error {
+	l.checkLock()
 	proto, err := loadBin(in, name)
 	if err != nil {
 		return err
 	}
-	envv := l.global
-	if env != 0 {
-		x, ok := l.get(env), false
-		envv, ok = x.(*table)
-		if !ok {
-			return errors.New("not a table: " + toString(x))
-		}
+	envv, err := l.env(env)
+	if err != nil {
+		return err
 	}
 	l.stack.Push(l.asFunc(proto, envv))
 	return nil
@@ -586,8 +635,9 @@ func (l *State) LoadBinary(in io.Reader, name string, env int) error {
 
 // LoadText loads a text chunk into memory and pushes the result onto the stack.
 // If there is an error it is returned and nothing is pushed.
-// Set env to 0 to use the default environment.
+// Set env to 0 to use the default environment, or to the index of a table or of nil.
 func (l *State) LoadText(in io.Reader, name string, env int) error {
+	l.checkLock()
 	source, err := ioutil.ReadAll(in)
 	if err != nil {
 		return err
@@ -596,18 +646,43 @@ func (l *State) LoadText(in io.Reader, name string, env int) error {
 	if err != nil {
 		return err
 	}
-	envv := l.global
-	if env != 0 {
-		x, ok := l.get(env), false
-		envv, ok = x.(*table)
-		if !ok {
-			return errors.New("not a table: " + toString(x))
-		}
+	envv, err := l.env(env)
+	if err != nil {
+		return err
 	}
 	l.stack.Push(l.asFunc(proto, envv))
 	return nil
 }
 
+// SetLoadMode sets the kinds of chunks that the load function of the base module may load,
+// "t" for text chunks, "b" for binary chunks or "bt" for both.
+// The default is "", which disables load, so scripts can't run code that the host didn't provide.
+// The loaded functions run in this State, so its limits and its context apply to them.
+func (l *State) SetLoadMode(mode string) {
+	l.loadMode = mode
+}
+
+// LoadMode returns the kinds of chunks that the load function may load, see SetLoadMode.
+func (l *State) LoadMode() string {
+	return l.loadMode
+}
+
+// env returns the table or nil at index i, or the global table if i is 0.
+// A chunk with a nil environment can't access any global variable.
+func (l *State) env(i int) (value, error) {
+	if i == 0 {
+		return l.global, nil
+	}
+	switch x := l.get(i).(type) {
+	case nil:
+		return nil, nil
+	case *table:
+		return x, nil
+	default:
+		return nil, errors.New("not a table: " + toString(x))
+	}
+}
+
 // Call runs a function with the given number of arguments and results.
 // The function must be on the stack just before the first argument.
 // If this raises an error the stack is NOT unwound!
@@ -616,51 +691,64 @@ func (l *State) Call(args, rtns int) {
 	if args < 0 {
 		panic(errors.New("invalid arg count: " + toString(int64(args))))
 	}
+	l.Lock()
+	defer l.Unlock()
+	l = l.inner
+
 	fi := -(args + 1) // Generate a relative index for the function
 	l.call(fi, args, rtns, false)
 }
 
 // PCall is exactly like Call, except instead of panicking when it encounters an error the error is cleanly recovered and returned.
 // On error the stack is reset to the way it was before the call minus the function and it's arguments, the State may then be reused.
+// If trace is true the error is returned as an *Error, which holds the error value and the failed frames.
+// Pending finalizers run before the call if it is not nested in another call, see RunFinalizers.
 func (l *State) PCall(args, rtns int, trace bool) (msg interface{}) {
+	return l.pcall(args, rtns, trace, nil)
+}
+
+// PCallHandler is like PCall, except that errors are passed to the message handler at the given stack index instead of being traced.
+// The handler is called with the error value before the stack is unwound, so the failing frames are still on the stack,
+// and the value it returns is returned as the error. Errors raised by native code are passed to the handler as strings.
+// If the handler itself raises an error, that error is returned instead.
+// Set handler to 0 to call without a message handler.
+func (l *State) PCallHandler(args, rtns, handler int) (msg interface{}) {
+	var h value
+	if handler != 0 {
+		h = l.get(handler)
+	}
+	return l.pcall(args, rtns, false, h)
+}
+
+func (l *State) pcall(args, rtns int, trace bool, handler value) (msg interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l = l.inner
+	if len(l.stack.frames) == 1 {
+		l.runFinalizers()
+	}
+
 	frames := len(l.stack.frames)
 	top := len(l.stack.data) - args - 1
+
+	// A protected call does not prevent the native function that made it from yielding.
+	nny := l.nny
+	if fr := l.stack.cFrame(); fr.fn != nil && fr.fn.native != nil && l.nny > 0 {
+		l.nny--
+	}
 	defer func() {
+		l.nny = nny
 		msg = recover()
+		if msg == errClosed {
+			panic(msg)
+		}
 		if msg != nil {
-			// Print trace
+			if handler != nil {
+				msg = l.callHandler(handler, msg)
+			}
+
 			if trace {
-				sources := []string{}
-				lines := []int{}
-				for i := len(l.stack.frames) - 1; i >= frames; i-- {
-					frame := l.stack.frames[i]
-					if frame.fn.native == nil {
-						sources = append(sources, frame.fn.proto.source)
-						if int(frame.pc) < len(frame.fn.proto.lineInfo) {
-							lines = append(lines, frame.fn.proto.lineInfo[frame.pc])
-						} else if len(frame.fn.proto.lineInfo) > 0 {
-							lines = append(lines, frame.fn.proto.lineInfo[len(frame.fn.proto.lineInfo)-1])
-						} else {
-							lines = append(lines, -1)
-						}
-					} else {
-						sources = append(sources, "(native code)")
-						lines = append(lines, -1)
-					}
-				}
-				fmt.Println("error:", msg)
-				for i := range sources {
-					if lines[i] == -1 {
-						fmt.Printf("    \"%v\"\n", sources[i])
-						continue
-					}
-					fmt.Printf("    \"%v\": <line: %v>\n", sources[i], lines[i])
-				}
-				if l.NativeTrace {
-					buf := make([]byte, 4096)
-					buf = buf[:runtime.Stack(buf, true)]
-					fmt.Printf("\nNative Trace:\n%s\n", buf)
-				}
+				msg = l.newError(msg, frames)
 			}
 
 			// Before we strip the stack we need to close all upvalues in the section we will be stripping, just in
@@ -679,6 +767,29 @@ func (l *State) PCall(args, rtns int, trace bool) (msg interface{}) {
 	return
 }
 
+// callHandler calls the message handler h with msg on top of the failed frames.
+// The handler can't yield, since the frame that raised the error can't be resumed.
+func (l *State) callHandler(h value, msg interface{}) (rtn interface{}) {
+	l.nny++
+	defer func() {
+		l.nny--
+		if e := recover(); e == errClosed {
+			panic(e)
+		} else if e != nil {
+			rtn = e
+		}
+	}()
+	if err, ok := msg.(error); ok {
+		msg = err.Error()
+	}
+	l.stack.Push(h)
+	l.stack.Push(msg)
+	l.Call(1, 1)
+	rtn = l.stack.Get(-1)
+	l.stack.Pop(1)
+	return
+}
+
 // Error pops a value off the top of the stack and raises it as an error.
 func (l *State) Error() {
 	msg := l.get(-1)
@@ -686,6 +797,21 @@ func (l *State) Error() {
 	panic(msg)
 }
 
+// Where returns the current position of the function at the given level of the call stack in the form "source:line:".
+// Level 0 is the running function, level 1 is the function that called it, and so on.
+// An empty string is returned for native functions and for levels that are not on the stack.
+// This is useful in a message handler to find out where an error was raised.
+func (l *State) Where(lvl int) string {
+	frame := l.stack.frame(lvl + 1)
+	if frame == nil || frame.fn == nil || frame.fn.native != nil {
+		return ""
+	}
+	if line := frame.line(); line >= 0 {
+		return fmt.Sprintf("%v:%v:", frame.fn.proto.source, line)
+	}
+	return frame.fn.proto.source + ":"
+}
+
 // PrintStack prints some stack information for sanity checking during test runs.
 func (l *State) PrintStack() {
 	n := l.AbsIndex(-1)
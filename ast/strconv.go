@@ -24,10 +24,10 @@ package ast
 
 import (
 	"errors"
+	"math"
 	"strings"
 )
 import "strconv"
-import "math"
 
 // ConvNumber converts a string to a number.
 // This is intended for internal use by various Lua related packages, you should not use this unless you know what you are doing.
@@ -61,14 +61,16 @@ func cton(r byte) byte {
 	panic("IMPOSSIBLE!")
 }
 
+// convInt converts an integer. Like in the reference implementation, hexadecimal integers wrap around
+// and decimal integers that don't fit in an int64 are not converted, so they are read as floats.
 func convInt(s string) (int64, bool) {
-	a := int64(0)
+	a := uint64(0)
 	i := 0
 	empty := true
 
 	neg := false
-	if len(s) >= i+1 && s[i] == '-' {
-		neg = true
+	if len(s) >= i+1 && (s[i] == '-' || s[i] == '+') {
+		neg = s[i] == '-'
 		i += 1
 	}
 
@@ -78,12 +80,20 @@ func convInt(s string) (int64, bool) {
 		hex = true
 	}
 
+	max := uint64(math.MaxInt64)
+	if neg {
+		max++
+	}
 	for ; i < len(s); i++ {
 		if s[i] >= '0' && s[i] <= '9' || hex && (s[i] >= 'a' && s[i] <= 'f' || s[i] >= 'A' && s[i] <= 'F') {
+			d := uint64(cton(s[i]))
 			if hex {
-				a = a*16 + int64(cton(s[i]))
+				a = a*16 + d
 			} else {
-				a = a*10 + int64(cton(s[i]))
+				if a > (max-d)/10 {
+					return 0, false // Overflow
+				}
+				a = a*10 + d
 			}
 			empty = false
 			continue
@@ -95,108 +105,112 @@ func convInt(s string) (int64, bool) {
 		return 0, false
 	}
 	if neg {
-		return -a, true
+		return -int64(a), true
 	}
-	return a, true
+	return int64(a), true
 }
 
-// No hexidecamal float support, but who uses hexadecimal floats anyway?
 func convFloat(s string) (float64, bool) {
-	if len(s) > 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
-		panic(errors.New("Sadly hexadecimal floating point literals are currently not supported, use decimal literals"))
+	if isHex(s) {
+		return convHexFloat(s)
+	}
+	if !isDecimal(s) {
+		return 0, false
 	}
+	return parseFloat(s)
+}
 
+// parseFloat converts a float checked by isDecimal or convHexFloat.
+// Like in the reference implementation, a number out of range is converted to an infinity or zero.
+func parseFloat(s string) (float64, bool) {
 	f, err := strconv.ParseFloat(s, 64)
-	return f, err == nil
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		return 0, false
+	}
+	return f, true
 }
 
-// My attempt a a float converter, basically implemented from the hexadecimal converter in "lobject.c".
-// The problem with this is that it doesn't work and I don't know why or how to fix it, I suck at this kind of math...
-func convFloatBroken(s string) (float64, bool) {
-	a := 0.0
-	e := 0
+// isDecimal returns true if s is a decimal float like "1", "1.5", ".5" or "1e-3", after an optional sign.
+// The other spellings accepted by strconv.ParseFloat, like "inf", "nan" or "1_000", are not numbers in Lua.
+func isDecimal(s string) bool {
 	i := 0
-	empty := true
-	dot := false
-
-	neg := false
-	if len(s) >= 1 && s[0] == '-' {
-		neg = true
-		i += 1
-	}
-
-	hex := false
-	if len(s) > i+2 && s[i+1] == '0' && (s[i+2] == 'x' || s[i+2] == 'X') {
-		i += 2
-		hex = true
+	if len(s) > 0 && (s[0] == '-' || s[0] == '+') {
+		i++
 	}
-
+	digits, dot := 0, false
 	for ; i < len(s); i++ {
-		if s[i] == '.' {
-			if dot {
-				return 0, false
-			}
+		if s[i] == '.' && !dot {
 			dot = true
-			continue
+		} else if s[i] >= '0' && s[i] <= '9' {
+			digits++
+		} else {
+			break
 		}
-
-		if s[i] >= '0' && s[i] <= '9' || hex && (s[i] >= 'a' && s[i] <= 'f' || s[i] >= 'A' && s[i] <= 'F') {
-			if hex {
-				a = a*16 + float64(cton(s[i]))
-			} else {
-				a = a*10 + float64(cton(s[i]))
-			}
-			empty = false
-			if dot {
-				e--
+	}
+	if digits == 0 {
+		return false
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		i++
+		if i < len(s) && (s[i] == '-' || s[i] == '+') {
+			i++
+		}
+		if i == len(s) {
+			return false
+		}
+		for ; i < len(s); i++ {
+			if s[i] < '0' || s[i] > '9' {
+				return false
 			}
-			continue
 		}
+	}
+	return i == len(s)
+}
+
+// isHex returns true if s starts with "0x" or "0X", after an optional sign.
+func isHex(s string) bool {
+	if len(s) > 0 && (s[0] == '-' || s[0] == '+') {
+		s = s[1:]
+	}
+	return len(s) >= 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X')
+}
 
-		if !hex && (s[i] == 'e' || s[i] == 'E') || hex && (s[i] == 'p' || s[i] == 'P') {
+// convHexFloat converts a hexadecimal float like "0x1.8p3". Unlike in Go the binary exponent is optional.
+func convHexFloat(s string) (float64, bool) {
+	i := strings.IndexAny(s, "xX") + 1
+	digits, dot := 0, false
+	for ; i < len(s); i++ {
+		if s[i] == '.' && !dot {
+			dot = true
+		} else if s[i] >= '0' && s[i] <= '9' || s[i] >= 'a' && s[i] <= 'f' || s[i] >= 'A' && s[i] <= 'F' {
+			digits++
+		} else {
 			break
 		}
-
-		return 0, false // Invalid character
 	}
-	if empty {
+	if digits == 0 {
 		return 0, false
 	}
-	e *= 4
-	if i < len(s) && (!hex && (s[i] == 'e' || s[i] == 'E') || hex && (s[i] == 'p' || s[i] == 'P')) {
-		ea := 0
-		empty = false
 
-		eneg := false
-		if len(s) >= i+1 && s[i+1] == '-' {
-			eneg = true
-			i += 1
+	if i == len(s) {
+		s += "p0"
+	} else {
+		if s[i] != 'p' && s[i] != 'P' {
+			return 0, false
 		}
-
-		for ; i < len(s); i++ {
-			if s[i] >= '0' && s[i] <= '9' {
-				ea = ea*10 + int(cton(s[i]))
-			}
-
-			return 0, false // Invalid character
+		i++
+		if i < len(s) && (s[i] == '-' || s[i] == '+') {
+			i++
 		}
-
-		if empty {
+		if i == len(s) {
 			return 0, false
 		}
-
-		if eneg {
-			ea = -ea
+		for ; i < len(s); i++ {
+			if s[i] < '0' || s[i] > '9' {
+				return 0, false
+			}
 		}
-		e += ea
-	}
-
-	if empty {
-		return 0, false
-	}
-	if neg {
-		a = -a
 	}
 
-	return math.Ldexp(a, e), true
+	return parseFloat(s)
 }
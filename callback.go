@@ -0,0 +1,182 @@
+/*
+Copyright 2019 by ofunc
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+)
+
+var functionType = reflect.TypeOf((*Function)(nil))
+
+// Function is a handle to a Lua function, which can be called from Go. Create one with State.Function.
+//
+// The function is kept alive in the registry until the handle is released, either with Release or
+// by the Go collector when the handle is no longer reachable.
+// The function is called on the State, or thread, that created the handle, under its lock (see Lock),
+// so the handle and the functions made by Bind can be called from any goroutine, the calls take turns.
+type Function struct {
+	l   *State
+	ref *funcRef
+}
+
+// funcRef is the registry key of a Function. It is not empty, so every key has its own address.
+type funcRef struct {
+	_ byte
+}
+
+// Function returns a handle to the function at index i, see Function.
+func (l *State) Function(i int) *Function {
+	fn, ok := l.get(i).(*function)
+	if !ok {
+		panic(errors.New("not a function: " + toString(l.get(i))))
+	}
+	return l.newFunction(fn)
+}
+
+func (l *State) newFunction(fn *function) *Function {
+	l.checkLock()
+	f := &Function{l: l.host, ref: new(funcRef)}
+	l.registry.Set(f.ref, fn)
+	runtime.SetFinalizer(f, func(f *Function) { f.l.queueFinalizer(f.ref) })
+	return f
+}
+
+// value returns the function, or nil if the handle was released.
+func (f *Function) value() value {
+	return f.l.registry.Get(f.ref)
+}
+
+// Release removes the function from the registry, the handle can't be called any more.
+func (f *Function) Release() {
+	f.l.Lock()
+	defer f.l.Unlock()
+	runtime.SetFinalizer(f, nil)
+	f.l.registry.Set(f.ref, nil)
+}
+
+// Call calls the function with the given arguments, which are pushed with PushGo.
+// The results are converted like ToGo does for interface{} values, and Lua functions are returned as *Function.
+// Errors raised by the function are returned as *Error.
+func (f *Function) Call(args ...interface{}) ([]interface{}, error) {
+	var rtns []interface{}
+	err := f.call(args, func(vs []value) error {
+		rtns = make([]interface{}, len(vs))
+		for i, v := range vs {
+			if err := f.l.decode(v, reflect.ValueOf(rtns).Index(i), "", 0); err != nil {
+				return fmt.Errorf("result #%v: %w", i+1, err)
+			}
+		}
+		return nil
+	})
+	return rtns, err
+}
+
+// call calls the function with args, and passes the results to out before they are removed from the stack.
+func (f *Function) call(args []interface{}, out func([]value) error) error {
+	f.l.Lock()
+	defer f.l.Unlock()
+	l := f.l.inner
+
+	fn := f.value()
+	if fn == nil {
+		return errors.New("call of a released function")
+	}
+	top := l.AbsIndex(-1)
+	l.stack.Push(fn)
+	for _, arg := range args {
+		l.PushGo(arg)
+	}
+	if msg := l.PCall(len(args), -1, true); msg != nil {
+		return msg.(*Error)
+	}
+	n := l.AbsIndex(-1) - top
+	defer l.stack.Pop(n)
+
+	vs := make([]value, n)
+	for i := range vs {
+		vs[i] = l.stack.Get(i - n)
+	}
+	return out(vs)
+}
+
+// Bind returns a Go function of type F that calls f, F must be a function type.
+//
+// The arguments are pushed with PushGo, and the results are converted to the result types of F like in ToGo,
+// missing results are zero. If the last result of F is an error, it receives the errors of the call and of the
+// conversions, otherwise they are raised as panics.
+func Bind[F any](f *Function) F {
+	t := reflect.TypeOf((*F)(nil)).Elem()
+	if t.Kind() != reflect.Func {
+		panic(fmt.Errorf("lua: Bind: %v is not a function type", t))
+	}
+	return f.makeFunc(t).Interface().(F)
+}
+
+// makeFunc returns a Go function of type t that calls f, see Bind.
+func (f *Function) makeFunc(t reflect.Type) reflect.Value {
+	return reflect.MakeFunc(t, func(in []reflect.Value) []reflect.Value {
+		var args []interface{}
+		for i, v := range in {
+			if t.IsVariadic() && i == len(in)-1 {
+				for j := 0; j < v.Len(); j++ {
+					args = append(args, v.Index(j).Interface())
+				}
+			} else {
+				args = append(args, v.Interface())
+			}
+		}
+
+		out := make([]reflect.Value, t.NumOut())
+		n := len(out)
+		hasErr := n > 0 && t.Out(n-1) == errorType
+		if hasErr {
+			n--
+		}
+		err := f.call(args, func(vs []value) error {
+			for i := 0; i < n; i++ {
+				out[i] = reflect.New(t.Out(i)).Elem()
+				if i < len(vs) {
+					if err := f.l.decode(vs[i], out[i], "", 0); err != nil {
+						return fmt.Errorf("result #%v: %w", i+1, err)
+					}
+				}
+			}
+			return nil
+		})
+		for i := range out {
+			if !out[i].IsValid() {
+				out[i] = reflect.Zero(t.Out(i))
+			}
+		}
+		if err != nil {
+			if !hasErr {
+				panic(err)
+			}
+			out[n] = reflect.ValueOf(&err).Elem()
+		}
+		return out
+	})
+}
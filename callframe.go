@@ -48,6 +48,10 @@ type callFrame struct {
 	retC    int // The actual number of items returned
 	retBase int // First value to return
 	retTo   int // Index (in previous frame) to place the first return value into.
+
+	// The pc and line of the last line hook.
+	hookPC   int32
+	hookLine int
 }
 
 // nxtOp gets the next opCode from a Lua function's code.
@@ -90,6 +94,22 @@ func (cf *callFrame) reqNxtOp(op opCode) instruction {
 	return i
 }
 
+// line returns the line of the current instruction of a Lua function, or -1 if there is no line information.
+func (cf *callFrame) line() int {
+	info := cf.fn.proto.lineInfo
+	pc := int(cf.pc) - 1
+	switch {
+	case len(info) == 0:
+		return -1
+	case pc < 0:
+		return info[0]
+	case pc >= len(info):
+		return info[len(info)-1]
+	default:
+		return info[pc]
+	}
+}
+
 func (cf *callFrame) getUp(i int) value {
 	if i < 0 || i >= len(cf.fn.up) {
 		panic(errors.New("Attempt to get out of range upvalue!"))
@@ -97,7 +117,7 @@ func (cf *callFrame) getUp(i int) value {
 
 	def := cf.fn.up[i]
 	if def.isLocal && !def.closed {
-		return cf.stk.GetAbs(def.absIdx)
+		return def.stk.GetAbs(def.absIdx)
 	}
 	if !def.closed {
 		panic("IMPOSSIBLE")
@@ -112,7 +132,7 @@ func (cf *callFrame) setUp(i int, v value) {
 	}
 	def := cf.fn.up[i]
 	if def.isLocal && !def.closed {
-		cf.stk.SetAbs(def.absIdx, v)
+		def.stk.SetAbs(def.absIdx, v)
 		return
 	}
 	if !def.closed {
@@ -172,6 +192,7 @@ func (cf *callFrame) findUp(def upDef) *upValue {
 			// This can only happen on the very first iteration, so check it last.
 			up := def.makeUp()
 			up.absIdx = idx
+			up.stk = cf.stk
 
 			cf.stk.unclosed = up
 			return up
@@ -182,6 +203,7 @@ func (cf *callFrame) findUp(def upDef) *upValue {
 			// New item should be inserted just before this item
 			up := def.makeUp()
 			up.absIdx = idx
+			up.stk = cf.stk
 
 			if pnode == nil {
 				up.next = node
@@ -195,6 +217,7 @@ func (cf *callFrame) findUp(def upDef) *upValue {
 			// If item should be added to the end of the list
 			up := def.makeUp()
 			up.absIdx = idx
+			up.stk = cf.stk
 
 			node.next = up
 			return up
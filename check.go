@@ -0,0 +1,129 @@
+/*
+Copyright 2019 by ofunc
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import (
+	"fmt"
+)
+
+// TypeError raises an error for the argument at index i of the running native function,
+// which is not of the expected type, like "bad argument #2 to 'sub' (number expected, got table)".
+// The type of the argument is the __name field of its meta table if it has one.
+func (l *State) TypeError(i int, expected string) {
+	got := "no value"
+	if i <= l.AbsIndex(-1) {
+		got = l.typeName(l.get(i))
+	}
+	l.ArgError(i, expected+" expected, got "+got)
+}
+
+// ArgError raises an error for the argument at index i of the running native function,
+// like "bad argument #1 to 'rep' (string too large)". The name of the function is "?" if it is unknown.
+func (l *State) ArgError(i int, msg string) {
+	name := "?"
+	if fr, ok := l.GetFrame(0); ok && fr.Name != "" {
+		name = fr.Name
+	}
+	panic(fmt.Errorf("bad argument #%v to '%v' (%v)", i, name, msg))
+}
+
+// CheckAny raises an error if there is no argument at index i.
+func (l *State) CheckAny(i int) {
+	if i > l.AbsIndex(-1) {
+		l.ArgError(i, "value expected")
+	}
+}
+
+// CheckString returns the string at index i, numbers are converted to strings.
+// It raises an error if the value is not a string or a number.
+func (l *State) CheckString(i int) string {
+	switch v := l.get(i).(type) {
+	case string:
+		return v
+	case int64, float64:
+		return toString(v)
+	}
+	l.TypeError(i, "string")
+	return ""
+}
+
+// CheckNumber returns the number at index i as a float, strings are converted to numbers.
+// It raises an error if the value is not a number or a string convertible to a number.
+func (l *State) CheckNumber(i int) float64 {
+	v := l.get(i)
+	switch v.(type) {
+	case int64, float64, string:
+		if f, err := tryFloat(v); err == nil {
+			return f
+		}
+	}
+	l.TypeError(i, "number")
+	return 0
+}
+
+// CheckInteger returns the integer at index i, floats with an exact integer value and strings are converted.
+// It raises an error if the value is not a number, or if it has no integer representation.
+func (l *State) CheckInteger(i int) int64 {
+	v := l.get(i)
+	switch v.(type) {
+	case int64, float64, string:
+		if n, err := tryInteger(v); err == nil {
+			return n
+		}
+		if _, err := tryFloat(v); err == nil {
+			l.ArgError(i, "number has no integer representation")
+		}
+	}
+	l.TypeError(i, "number")
+	return 0
+}
+
+// CheckTable raises an error if the value at index i is not a table.
+func (l *State) CheckTable(i int) {
+	if _, ok := l.get(i).(*table); !ok {
+		l.TypeError(i, "table")
+	}
+}
+
+// CheckType raises an error if the value at index i is not of type t.
+func (l *State) CheckType(i int, t TypeID) {
+	if typeOf(l.get(i)) != t {
+		l.TypeError(i, t.String())
+	}
+}
+
+// CheckOption returns the index in options of the string at index i, or of def if the value is nil and def is not empty.
+// It raises an error if the string is not one of the options, like "bad argument #2 to 'seek' (invalid option 'x')".
+func (l *State) CheckOption(i int, def string, options []string) int {
+	name := def
+	if def == "" || !l.IsNil(i) {
+		name = l.CheckString(i)
+	}
+	for k, o := range options {
+		if o == name {
+			return k
+		}
+	}
+	l.ArgError(i, "invalid option '"+name+"'")
+	return -1
+}
@@ -484,11 +484,15 @@ func expr(e ast.Expr, state *compState, reg int, boolRev bool) exprData {
 
 	switch ee := e.(type) {
 	case *ast.Operator:
+		if v, ok := fold(ee); ok {
+			rtn.constant = state.constK(v)
+			break
+		}
+
 		// Operator precedence is already handled by the AST, Yay!
 		switch ee.Op {
 		// Simple binary operators
 		case ast.OpAdd, ast.OpSub, ast.OpMul, ast.OpMod, ast.OpPow, ast.OpDiv, ast.OpIDiv, ast.OpBinAND, ast.OpBinOR, ast.OpBinXOR, ast.OpBinShiftL, ast.OpBinShiftR:
-			// TODO: Constant folding
 			l, lu := expr(ee.Left, state, reg, false).RK()
 			r := reg
 			if lu {
@@ -500,7 +504,6 @@ func expr(e ast.Expr, state *compState, reg int, boolRev bool) exprData {
 
 		// Simple unary operators
 		case ast.OpUMinus, ast.OpBinNot, ast.OpNot, ast.OpLength:
-			// TODO: Constant folding for OpUMinus and OpBinNot
 			v, _ := expr(ee.Right, state, reg, false).RK()
 			state.addInst(createABC(opCode(ee.Op)+OpAdd, reg, v, 0), ee.Line())
 			rtn.register = true
@@ -518,6 +521,11 @@ func expr(e ast.Expr, state *compState, reg int, boolRev bool) exprData {
 				last++
 				en = een.Right
 				een, ok = en.(*ast.Operator)
+				if ok {
+					// Keep a constant tail in one piece, so it is folded.
+					_, c := fold(een)
+					ok = !c
+				}
 			}
 			expr(en, state, last, false).To(false)
 
@@ -0,0 +1,91 @@
+/*
+Copyright 2019 by ofunc
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import (
+	"math"
+
+	"github.com/ofunc/lua/ast"
+)
+
+// fold returns the value of the expression e if it can be computed at compile time.
+// Arithmetic on numbers is computed by arithRaw, exactly as at runtime, and strings are concatenated.
+//
+// Some expressions are never folded:
+//   - % and //, since their results depend on SetTruncatedDivision and dividing by zero is an error;
+//   - arithmetic on strings and concatenation of numbers, which convert their operands at runtime;
+//   - results that are NaN or a float zero, which would be merged with other constants (-0.0 == 0.0).
+func fold(e ast.Expr) (value, bool) {
+	switch ee := e.(type) {
+	case *ast.ConstInt:
+		return toInteger(ee.Value), true
+	case *ast.ConstFloat:
+		return toFloat(ee.Value), true
+	case *ast.ConstString:
+		return ee.Value, true
+	case *ast.Parens:
+		return fold(ee.Inner)
+	case *ast.Operator:
+		switch ee.Op {
+		case ast.OpAdd, ast.OpSub, ast.OpMul, ast.OpPow, ast.OpDiv, ast.OpBinAND, ast.OpBinOR, ast.OpBinXOR, ast.OpBinShiftL, ast.OpBinShiftR:
+			if a, ok := foldNumber(ee.Left); ok {
+				if b, ok := foldNumber(ee.Right); ok {
+					return foldArith(opCode(ee.Op)+OpAdd, a, b)
+				}
+			}
+		case ast.OpUMinus, ast.OpBinNot:
+			if a, ok := foldNumber(ee.Right); ok {
+				return foldArith(opCode(ee.Op)+OpAdd, a, a)
+			}
+		case ast.OpConcat:
+			if a, ok := fold(ee.Left); ok {
+				if b, ok := fold(ee.Right); ok {
+					sa, oka := a.(string)
+					sb, okb := b.(string)
+					if oka && okb {
+						return sa + sb, true
+					}
+				}
+			}
+		}
+	}
+	return nil, false
+}
+
+// foldNumber returns the value of the expression e if it is a number that can be computed at compile time.
+func foldNumber(e ast.Expr) (value, bool) {
+	v, ok := fold(e)
+	switch v.(type) {
+	case int64, float64:
+		return v, ok
+	}
+	return nil, false
+}
+
+func foldArith(op opCode, a, b value) (value, bool) {
+	v, ok := arithRaw(op, a, b, false)
+	if f, isf := v.(float64); isf && (f == 0 || math.IsNaN(f)) {
+		return nil, false
+	}
+	return v, ok
+}
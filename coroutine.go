@@ -0,0 +1,320 @@
+/*
+Copyright 2019 by ofunc
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import (
+	"errors"
+	"runtime"
+)
+
+// ThreadStatus is the status of a coroutine.
+type ThreadStatus int
+
+const (
+	ThreadRunning ThreadStatus = iota
+	ThreadSuspended
+	ThreadNormal
+	ThreadDead
+)
+
+var threadStatusNames = []string{"running", "suspended", "normal", "dead"}
+
+func (s ThreadStatus) String() string {
+	return threadStatusNames[s]
+}
+
+// errClosed is raised inside a suspended coroutine when it is closed.
+// It must never be caught by PCall, so the goroutine of the coroutine can exit.
+var errClosed = errors.New("coroutine closed")
+
+// coroutine is the VM's thread type.
+// Every coroutine runs on its own State and goroutine, but only one of them runs at a time.
+//
+// The goroutine of a suspended coroutine is released when its handle is collected, when it is closed,
+// or when its State is closed, or done, or collected (see Close). The last ones cover the coroutines
+// that are part of a reference cycle, which Go never collects while their goroutine waits.
+type coroutine struct {
+	l       *State
+	started bool
+}
+
+// close is the finalizer of coroutine, it releases the goroutine of a suspended coroutine.
+func (co *coroutine) close() {
+	co.l.release(co.l)
+}
+
+// release releases the goroutine of the coroutine co, if it still has one.
+func (g *globalState) release(co *State) {
+	g.coMu.Lock()
+	ok := g.coroutines[co]
+	delete(g.coroutines, co)
+	g.coMu.Unlock()
+	if ok {
+		close(co.resume)
+	}
+}
+
+// closeCoroutines kills the suspended coroutines and releases their goroutines, the lock must be held.
+func (g *globalState) closeCoroutines() {
+	g.coMu.Lock()
+	var cos []*State
+	for co := range g.coroutines {
+		if co.status == ThreadSuspended {
+			co.status = ThreadDead
+			delete(g.coroutines, co)
+			cos = append(cos, co)
+		}
+	}
+	g.coMu.Unlock()
+	for _, co := range cos {
+		close(co.resume)
+	}
+}
+
+// Close kills the suspended coroutines of the State and of its threads, and releases their goroutines.
+// The State can still be used, only the coroutines are affected.
+//
+// This is also done when the context of the State is done, and when the host States (the one of NewState and
+// the ones of NewThread) are all collected, so Close is only needed to release the goroutines earlier.
+// A State isn't collected while a Lua value refers to one of its host States, for example the result
+// of coroutine.running outside of a coroutine.
+func (l *State) Close() {
+	l.Lock()
+	defer l.Unlock()
+	l.closeCoroutines()
+}
+
+// track counts the host State l, the coroutines are closed when all of the host States are collected.
+func (l *State) track() {
+	l.states.Add(1)
+	runtime.AddCleanup(l, (*globalState).untrack, l.globalState)
+}
+
+func (g *globalState) untrack() {
+	if g.states.Add(-1) != 0 {
+		return
+	}
+	// Nothing can resume the coroutines any more.
+	g.coMu.Lock()
+	cos := g.coroutines
+	g.coroutines = nil
+	g.coMu.Unlock()
+	for co := range cos {
+		close(co.resume)
+	}
+}
+
+type transfer struct {
+	vals []value
+	err  interface{}
+	dead bool
+}
+
+// NewCoroutine pops a function from the stack and pushes a new coroutine that will run it.
+// The coroutine shares the registry, the globals and the type meta tables with this State.
+func (l *State) NewCoroutine() {
+	l.checkLock()
+	v := l.stack.Get(-1)
+	if _, ok := v.(*function); !ok {
+		panic(errors.New("not a function: " + toString(v)))
+	}
+	l.stack.Pop(1)
+
+	co := newThreadState(&threadState{
+		NativeTrace: l.NativeTrace,
+		globalState: l.globalState,
+		stack:       newStack(),
+		status:      ThreadSuspended,
+		resume:      make(chan []value),
+		yield:       make(chan transfer),
+	})
+	co.stack.Push(v)
+	l.coMu.Lock()
+	if l.coroutines == nil {
+		l.coroutines = make(map[*State]bool)
+	}
+	l.coroutines[co] = true
+	l.coMu.Unlock()
+
+	h := &coroutine{l: co}
+	runtime.SetFinalizer(h, (*coroutine).close)
+	l.stack.Push(h)
+}
+
+// Resume starts or continues the coroutine at the given index.
+// The top args values are popped from the stack and passed to the coroutine, either as the arguments of its function or as the results of Yield.
+// When the coroutine yields or returns, its values are pushed onto the stack and their number is returned.
+// If the coroutine raises an error, or can't be resumed, the error is returned, nothing is pushed and the coroutine is dead.
+func (l *State) Resume(i, args int) (n int, msg interface{}) {
+	l.Lock()
+	defer l.Unlock()
+
+	v := l.get(i)
+	h, ok := v.(*coroutine)
+	if !ok {
+		panic(errors.New("not a coroutine: " + toString(v)))
+	}
+	co := h.l
+	vals := l.popValues(args)
+	switch co.status {
+	case ThreadSuspended:
+	case ThreadDead:
+		return 0, "cannot resume dead coroutine"
+	default:
+		return 0, "cannot resume non-suspended coroutine"
+	}
+
+	co.status = ThreadRunning
+	co.co = h
+	l.status = ThreadNormal
+	if !h.started {
+		h.started = true
+		go co.run()
+	}
+	co.resume <- vals
+	t := <-co.yield
+	l.status = ThreadRunning
+	co.co = nil
+
+	if t.dead {
+		co.status = ThreadDead
+		l.release(co)
+	} else {
+		co.status = ThreadSuspended
+	}
+	if t.err != nil {
+		return 0, t.err
+	}
+	for _, v := range t.vals {
+		l.stack.Push(v)
+	}
+	return len(t.vals), nil
+}
+
+// CloseCoroutine closes the coroutine at the given index, which must be suspended or dead.
+// The coroutine becomes dead and the goroutine of a suspended coroutine is released, see Close for the other ways.
+func (l *State) CloseCoroutine(i int) error {
+	l.Lock()
+	defer l.Unlock()
+
+	v := l.get(i)
+	h, ok := v.(*coroutine)
+	if !ok {
+		panic(errors.New("not a coroutine: " + toString(v)))
+	}
+	co := h.l
+	switch co.status {
+	case ThreadSuspended, ThreadDead:
+	default:
+		return errors.New("cannot close a " + co.status.String() + " coroutine")
+	}
+	co.status = ThreadDead
+	runtime.SetFinalizer(h, nil)
+	l.release(co)
+	return nil
+}
+
+// Yield suspends the running coroutine, the top n values are popped from the stack and returned by Resume.
+// When the coroutine is resumed again, the values passed to Resume are pushed onto the stack and their number is returned.
+// Yield may only be called from a native function that was called from Lua code or directly by Resume,
+// yielding across Call (for example from a table.sort comparator) raises an error.
+func (l *State) Yield(n int) int {
+	if l.resume == nil {
+		panic(errors.New("attempt to yield from outside a coroutine"))
+	}
+	if l.nny > 1 {
+		panic(errors.New("attempt to yield across a native call boundary"))
+	}
+
+	l.yield <- transfer{vals: l.popValues(n)}
+	vals, ok := <-l.resume
+	if !ok {
+		panic(errClosed)
+	}
+	for _, v := range vals {
+		l.stack.Push(v)
+	}
+	return len(vals)
+}
+
+// IsYieldable returns true if the running native function can call Yield.
+func (l *State) IsYieldable() bool {
+	return l.resume != nil && l.nny <= 1
+}
+
+// PushThread pushes the running coroutine onto the stack.
+// Returns true if it is the main coroutine of the State.
+func (l *State) PushThread() bool {
+	if l.co == nil {
+		l.co = &coroutine{l: l.host, started: true}
+	}
+	l.stack.Push(l.co)
+	return l.resume == nil
+}
+
+// StatusOf returns the status of the coroutine at the given index.
+// If the value is not a coroutine this will raise an error.
+func (l *State) StatusOf(i int) ThreadStatus {
+	v := l.get(i)
+	if h, ok := v.(*coroutine); ok {
+		return h.l.status
+	}
+	panic(errors.New("not a coroutine: " + toString(v)))
+}
+
+// run is the body of the goroutine of a coroutine.
+func (l *State) run() {
+	vals, ok := <-l.resume
+	if !ok {
+		return
+	}
+
+	t := transfer{dead: true}
+	func() {
+		defer func() {
+			t.err = recover()
+		}()
+		for _, v := range vals {
+			l.stack.Push(v)
+		}
+		l.Call(len(vals), -1)
+		t.vals = l.popValues(l.stack.TopIndex() + 1)
+	}()
+	if t.err == errClosed {
+		return
+	}
+	l.yield <- t
+}
+
+// popValues pops the top n values from the stack and returns them in order.
+func (l *State) popValues(n int) []value {
+	if n > l.stack.TopIndex()+1 {
+		panic(errors.New("not enough values on the stack"))
+	}
+	vals := make([]value, n)
+	for i := range vals {
+		vals[i] = l.stack.Get(i - n)
+	}
+	l.stack.Pop(n)
+	return vals
+}
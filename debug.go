@@ -0,0 +1,249 @@
+/*
+Copyright 2019 by ofunc
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+// HookEvent is the event that caused a hook to be called.
+type HookEvent int
+
+const (
+	HookCall HookEvent = iota
+	HookReturn
+	HookLine
+	HookCount
+)
+
+var hookEventNames = []string{"call", "return", "line", "count"}
+
+func (e HookEvent) String() string {
+	return hookEventNames[e]
+}
+
+// Masks for SetHook.
+const (
+	MaskCall   = 1 << HookCall
+	MaskReturn = 1 << HookReturn
+	MaskLine   = 1 << HookLine
+	MaskCount  = 1 << HookCount
+)
+
+// Hook is a function called by the VM while it executes Lua code.
+// The function that caused the event is at level 0 of the call stack, see GetFrame.
+// line is the current line of that function, or -1 if it is native or has no line information.
+// A hook must keep the stack balanced, and no hooks are called while a hook is running.
+type Hook func(l *State, event HookEvent, line int)
+
+// Frame describes a function on the call stack.
+type Frame struct {
+	Name        string // The name of the function, or "" if it is unknown
+	Source      string // The chunk name of a Lua function, or "(native code)"
+	Line        int    // The current line of a Lua function, or -1 if it is unknown
+	LineDefined int    // The line where a Lua function was defined, or -1 if it is unknown
+	Native      bool   // Is the function native?
+}
+
+// SetHook sets the hook of the State and all of its coroutines.
+// mask is a combination of MaskCall, MaskReturn, MaskLine and MaskCount:
+//
+//	MaskCall: called when a function is entered, after its frame is pushed.
+//	MaskReturn: called when a function is about to return, before its frame is dropped.
+//	MaskLine: called before an instruction of a Lua function when the line changes or the code jumps back,
+//	          if the instruction has line information.
+//	MaskCount: called before every count instructions.
+//
+// Set f to nil or mask to 0 to remove the hook.
+func (l *State) SetHook(f Hook, mask int, count int) {
+	if count <= 0 {
+		mask &^= MaskCount
+	}
+	if f == nil || mask == 0 {
+		f, mask, count = nil, 0, 0
+	}
+	l.steps += l.period - l.count
+	l.hook = f
+	l.hookMask = mask
+	l.hookCount = int64(count)
+	l.hookLeft = int64(count)
+	l.resetCount()
+}
+
+// GetFrame returns information about the function at the given level of the call stack.
+// Level 0 is the running function, level 1 is the function that called it, and so on.
+// It returns false if there is no function at that level.
+func (l *State) GetFrame(lvl int) (Frame, bool) {
+	if lvl < 0 {
+		return Frame{}, false
+	}
+	frame := l.stack.frame(lvl + 1)
+	if frame == nil || frame.fn == nil {
+		return Frame{}, false
+	}
+	fr := Frame{
+		Name:        funcName(l.stack.frame(lvl + 2)),
+		Source:      "(native code)",
+		Line:        -1,
+		LineDefined: -1,
+		Native:      true,
+	}
+	if frame.fn.native == nil {
+		fr.Source = frame.fn.proto.source
+		fr.Line = frame.line()
+		fr.LineDefined = frame.fn.proto.lineDefined
+		fr.Native = false
+	}
+	return fr, true
+}
+
+// callHook calls the hook for the running function.
+func (l *State) callHook(event HookEvent) {
+	if l.hooking {
+		return
+	}
+	l.hooking = true
+	defer func() {
+		l.hooking = false
+	}()
+
+	line := -1
+	if fr := l.stack.cFrame(); fr.fn != nil && fr.fn.native == nil {
+		line = fr.line()
+	}
+	l.hook(l.inner, event, line)
+}
+
+// stepHook is called by checkLimits for the line and count hooks.
+func (l *State) stepHook() {
+	if l.hookMask&MaskCount != 0 {
+		l.hookLeft -= l.period
+		if l.hookLeft <= 0 {
+			l.hookLeft = l.hookCount
+			l.callHook(HookCount)
+		}
+	}
+	if l.hookMask&MaskLine != 0 {
+		fr := l.stack.cFrame()
+		if fr.fn == nil || fr.fn.native != nil {
+			return
+		}
+		pc, line := fr.pc-1, fr.line()
+		if line >= 0 && (pc <= fr.hookPC || line != fr.hookLine) {
+			l.callHook(HookLine)
+		}
+		fr.hookPC, fr.hookLine = pc, line
+	}
+}
+
+// funcName tries to find the name of the function called by the given frame from the calling instruction.
+func funcName(caller *callFrame) string {
+	if caller == nil || caller.fn == nil || caller.fn.native != nil {
+		return ""
+	}
+	p := &caller.fn.proto
+	pc := int(caller.pc) - 1
+	if pc < 0 || pc >= len(p.code) {
+		return ""
+	}
+	switch i := p.code[pc]; i.getOpCode() {
+	case opCall, opTailCall:
+		return p.objName(pc, i.a())
+	case opTForCall:
+		return "for iterator"
+	default:
+		return ""
+	}
+}
+
+// objName tries to find a name for the value in register reg at the given pc.
+func (p *funcProto) objName(lastpc, reg int) string {
+	if name := p.localName(lastpc, reg); name != "" {
+		return name
+	}
+	pc := p.findSetReg(lastpc, reg)
+	if pc < 0 {
+		return ""
+	}
+	switch i := p.code[pc]; i.getOpCode() {
+	case opMove:
+		if b := i.b(); b < i.a() {
+			return p.objName(pc, b)
+		}
+	case opGetUpValue:
+		if b := i.b(); b < len(p.upVals) {
+			return p.upVals[b].name
+		}
+	case opGetTableUp, opGetTable, opSelf:
+		if c := i.c(); isK(c) {
+			if name, ok := p.constants[indexK(c)].(string); ok {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// localName returns the name of the local variable in register reg at the given pc, or "" if there is none.
+func (p *funcProto) localName(pc, reg int) string {
+	for _, v := range p.localVars {
+		if int(v.sPC) <= pc && pc < int(v.ePC) {
+			if reg == 0 {
+				return v.name
+			}
+			reg--
+		}
+	}
+	return ""
+}
+
+// findSetReg returns the pc of the last instruction before lastpc that changed register reg, or -1.
+func (p *funcProto) findSetReg(lastpc, reg int) int {
+	setreg, jmptarget := -1, 0
+	for pc := 0; pc < lastpc; pc++ {
+		i := p.code[pc]
+		a, change := i.a(), false
+		switch i.getOpCode() {
+		case opLoadNil:
+			change = a <= reg && reg <= a+i.b()
+		case opTForCall:
+			change = reg >= a+2
+		case opCall, opTailCall:
+			change = reg >= a
+		case opJump:
+			if dest := pc + 1 + i.sbx(); pc < dest && dest <= lastpc && dest > jmptarget {
+				jmptarget = dest
+			}
+		case opSelf:
+			change = reg == a || reg == a+1
+		case opSetTableUp, opSetUpValue, opSetTable, OpEqual, OpLessThan, OpLessOrEqual,
+			opTest, opReturn, opTForLoop, opSetList, opExtraArg:
+		default:
+			change = reg == a
+		}
+		if change {
+			if pc < jmptarget {
+				setreg = -1
+			} else {
+				setreg = pc
+			}
+		}
+	}
+	return setreg
+}
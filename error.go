@@ -0,0 +1,88 @@
+/*
+Copyright 2019 by ofunc
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+)
+
+// Error is the error returned by PCall when trace is true.
+// It keeps the error value together with the call stack at the point the error was raised.
+type Error struct {
+	Value  interface{} // The error value
+	Frames []Frame     // The failed frames, innermost first
+	Stack  []byte      // The Go stack, only if NativeTrace is set
+}
+
+// Error returns the message of the error value.
+func (e *Error) Error() string {
+	if err, ok := e.Value.(error); ok {
+		return err.Error()
+	}
+	if typeOf(e.Value) == TypeUnknown {
+		return fmt.Sprint(e.Value)
+	}
+	return toString(e.Value)
+}
+
+// Unwrap returns the error value if it is an error, so errors.Is and errors.As work as expected.
+func (e *Error) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// Traceback formats the error message and the frames, one per line.
+func (e *Error) Traceback() string {
+	var b strings.Builder
+	b.WriteString(e.Error())
+	for _, fr := range e.Frames {
+		if fr.Line < 0 {
+			fmt.Fprintf(&b, "\n    %q", fr.Source)
+		} else {
+			fmt.Fprintf(&b, "\n    %q: <line: %v>", fr.Source, fr.Line)
+		}
+		if fr.Name != "" {
+			fmt.Fprintf(&b, " in function '%v'", fr.Name)
+		}
+	}
+	if len(e.Stack) > 0 {
+		fmt.Fprintf(&b, "\n\nNative Trace:\n%s", e.Stack)
+	}
+	return b.String()
+}
+
+// newError creates an Error for msg with the frames above the given frame count.
+func (l *State) newError(msg interface{}, frames int) *Error {
+	e := &Error{Value: msg}
+	for i := 0; i < len(l.stack.frames)-frames; i++ {
+		if fr, ok := l.GetFrame(i); ok {
+			e.Frames = append(e.Frames, fr)
+		}
+	}
+	if l.NativeTrace {
+		e.Stack = debug.Stack()
+	}
+	return e
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2019 by ofunc
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import (
+	"runtime"
+)
+
+// setFinalizer marks v for finalization if the meta table m has a __gc field, like the reference implementation
+// does when the meta table is set. v must be a *table or a *userdata.
+//
+// Go finalizers only queue the value, the __gc meta methods run on the State at the next safe point,
+// see RunFinalizers. Go never collects an object with a finalizer that is part of a reference cycle,
+// since the finalizer could use the other objects of the cycle, and a Go finalizer must be on the value itself,
+// to pass it to __gc.
+func (g *globalState) setFinalizer(v value, m *table) {
+	gc := m != nil && m.Get("__gc") != nil
+	switch x := v.(type) {
+	case *table:
+		runtime.SetFinalizer(x, nil)
+		if gc {
+			runtime.SetFinalizer(x, func(x *table) { g.queueFinalizer(x) })
+		}
+	case *userdata:
+		runtime.SetFinalizer(x, nil)
+		if gc {
+			runtime.SetFinalizer(x, func(x *userdata) { g.queueFinalizer(x) })
+		}
+	}
+}
+
+// queueFinalizer is called by Go finalizers, on their own goroutine.
+func (g *globalState) queueFinalizer(v value) {
+	g.finMu.Lock()
+	g.fin = append(g.fin, v)
+	g.finMu.Unlock()
+}
+
+func (g *globalState) nextFinalizer() value {
+	g.finMu.Lock()
+	defer g.finMu.Unlock()
+	if len(g.fin) == 0 {
+		return nil
+	}
+	v := g.fin[0]
+	g.fin[0] = nil
+	g.fin = g.fin[1:]
+	return v
+}
+
+// RunFinalizers runs the __gc meta methods of the values that were collected by Go since the last run.
+// Finalizers also run at the start of every PCall that is not nested in another call,
+// they never run concurrently with other Lua code of the State.
+// A finalizer is called with the value as its only argument, and it is called only once,
+// unless the meta table is set again. Errors raised by finalizers don't stop the others,
+// the first one is returned as an *Error.
+//
+// A finalizable value that can reach itself, for example a table with a field that refers to the table,
+// or a userdata whose meta table has a closure that refers to the userdata, is never finalized and never freed,
+// the Go collector keeps the whole cycle. Such values must be closed explicitly, or their cycles broken.
+func (l *State) RunFinalizers() error {
+	l.Lock()
+	defer l.Unlock()
+	return l.inner.runFinalizers()
+}
+
+func (l *State) runFinalizers() (err error) {
+	if l.finalizing {
+		return nil
+	}
+	l.finalizing = true
+	defer func() {
+		l.finalizing = false
+	}()
+
+	for v := l.nextFinalizer(); v != nil; v = l.nextFinalizer() {
+		if ref, ok := v.(*funcRef); ok {
+			// A Function handle was collected.
+			l.registry.Set(ref, nil)
+			continue
+		}
+		f := l.getMetaField(v, "__gc")
+		if f == nil {
+			continue
+		}
+		l.stack.Push(f)
+		l.stack.Push(v)
+		if msg := l.pcall(1, 0, true, nil); msg != nil && err == nil {
+			err = msg.(*Error)
+		}
+	}
+	return err
+}
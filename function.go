@@ -196,8 +196,9 @@ type upValue struct {
 
 	// closure information
 	closed bool
-	val    value // closed
-	absIdx int   // isLocal && !closed (absolute stack index)
+	val    value  // closed
+	absIdx int    // isLocal && !closed (absolute stack index)
+	stk    *stack // isLocal && !closed (the stack that absIdx refers to)
 
 	// Unclosed link info, nil if not part of the unclosed list (the head pointer is part of the stack)
 	next *upValue
@@ -0,0 +1,435 @@
+/*
+Copyright 2019 by ofunc
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// goType is the binding of a Go type, shared by the functions of its meta table.
+type goType struct {
+	t       reflect.Type
+	methods map[string]value // The method functions, created when first used
+}
+
+// PushGo pushes a Go value, exposing it to Lua through reflection.
+//
+// Booleans, numbers and strings are converted to Lua values, nil pointers, maps, slices, functions and
+// interfaces are pushed as nil, Lua values and func(*State) int are pushed as they are,
+// and a *Function is pushed as its function.
+// Any other value is pushed as a userdata with a meta table that is created once for its type:
+//
+//	Structs and pointers to structs: exported fields can be read and, through a pointer, assigned.
+//	Methods are called with the colon syntax, obj:Method(args).
+//	Maps: indexing reads, assigning writes, assigning nil deletes.
+//	Slices and arrays: 1-based indexing, elements of slices can be assigned.
+//	Functions: the value can be called.
+//	# gives the length of maps, slices, arrays and channels, and pairs traverses maps, slices, arrays and structs.
+//
+// Arguments are converted to the Go types of the parameters and fields like in ToGo, and raise an error if that is not possible.
+// Results are converted with PushGo, so structs reached through pointers, slices or fields stay shared with Go.
+// If the last result of a function or method is an error, it is not pushed: if it is not nil,
+// nil and the error message are returned instead of the other results.
+func (l *State) PushGo(v interface{}) {
+	l.checkLock()
+	l.pushGo(reflect.ValueOf(v))
+}
+
+func (l *State) pushGo(rv reflect.Value) {
+	if !rv.IsValid() {
+		l.stack.Push(nil)
+		return
+	}
+	switch rv.Kind() {
+	case reflect.Bool:
+		l.stack.Push(rv.Bool())
+		return
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		l.stack.Push(rv.Int())
+		return
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		l.stack.Push(fromUint(rv.Uint()))
+		return
+	case reflect.Float32, reflect.Float64:
+		l.stack.Push(rv.Float())
+		return
+	case reflect.String:
+		l.stack.Push(rv.String())
+		return
+	case reflect.Interface:
+		l.pushGo(rv.Elem())
+		return
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+		if rv.IsNil() {
+			l.stack.Push(nil)
+			return
+		}
+	case reflect.Struct, reflect.Array:
+		// Keep values that live in Go memory shared.
+		if rv.CanAddr() {
+			rv = rv.Addr()
+		}
+	}
+
+	switch x := rv.Interface().(type) {
+	case *table, *function, *userdata, *coroutine:
+		l.stack.Push(x)
+	case *Function:
+		l.stack.Push(x.value())
+	case func(*State) int:
+		l.Push(x)
+	default:
+		u := &userdata{data: x, meta: l.goMeta(rv.Type())}
+		l.setFinalizer(u, u.meta)
+		l.stack.Push(u)
+	}
+}
+
+// fromUint converts an unsigned integer to a Lua integer, or to a float if it is larger than math.MaxInt64.
+func fromUint(u uint64) value {
+	if u > math.MaxInt64 {
+		return float64(u)
+	}
+	return int64(u)
+}
+
+// goMeta returns the meta table of the Go type t.
+func (l *State) goMeta(t reflect.Type) *table {
+	if m, ok := l.goTypes[t]; ok {
+		return m
+	}
+	if l.goTypes == nil {
+		l.goTypes = make(map[reflect.Type]*table)
+	}
+
+	gt := &goType{t: t, methods: make(map[string]value)}
+	m := newTable(l, 0, 8)
+	fns := map[string]func(*State) int{
+		"__index":    gt.index,
+		"__newindex": gt.newindex,
+		"__len":      gt.len,
+		"__pairs":    gt.pairs,
+		"__eq":       goEqual,
+		"__tostring": goString,
+	}
+	if t.Kind() == reflect.Func {
+		fns["__call"] = gt.call
+	}
+	for k, f := range fns {
+		l.Push(f)
+		m.Set(k, l.stack.Get(-1))
+		l.stack.Pop(1)
+	}
+	l.goTypes[t] = m
+	return m
+}
+
+// self returns the Go value of the userdata at index 1.
+func (gt *goType) self(l *State) reflect.Value {
+	if u, ok := l.get(1).(*userdata); ok {
+		if rv := reflect.ValueOf(u.data); rv.Type() == gt.t {
+			return rv
+		}
+	}
+	panic(fmt.Errorf("bad self: %v expected, got %v", gt.t, l.TypeOf(1)))
+}
+
+// elem dereferences pointers, it raises an error for nil pointers.
+func elem(rv reflect.Value) reflect.Value {
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			panic(errors.New("attempt to index a nil pointer"))
+		}
+		rv = rv.Elem()
+	}
+	return rv
+}
+
+func (gt *goType) index(l *State) int {
+	rv := gt.self(l)
+	k := l.get(2)
+	if name, ok := k.(string); ok {
+		if f := gt.method(l, name); f != nil {
+			l.stack.Push(f)
+			return 1
+		}
+	}
+
+	switch rv = elem(rv); rv.Kind() {
+	case reflect.Struct:
+		l.pushGo(field(rv, k))
+	case reflect.Map:
+		l.pushGo(rv.MapIndex(l.goArg(k, rv.Type().Key(), 2)))
+	case reflect.Slice, reflect.Array:
+		if i, ok := sliceIndex(rv, k); ok {
+			l.pushGo(rv.Index(i))
+		} else {
+			l.stack.Push(nil)
+		}
+	default:
+		panic(fmt.Errorf("attempt to index a %v value", gt.t))
+	}
+	return 1
+}
+
+func (gt *goType) newindex(l *State) int {
+	rv := elem(gt.self(l))
+	k, v := l.get(2), l.get(3)
+	switch rv.Kind() {
+	case reflect.Struct:
+		f := field(rv, k)
+		if !f.CanSet() {
+			panic(fmt.Errorf("cannot assign to field %v of %v, use a pointer", k, gt.t))
+		}
+		f.Set(l.goArg(v, f.Type(), 3))
+	case reflect.Map:
+		if rv.IsNil() {
+			panic(errors.New("assignment to entry in nil map"))
+		}
+		key := l.goArg(k, rv.Type().Key(), 2)
+		if v == nil {
+			rv.SetMapIndex(key, reflect.Value{})
+		} else {
+			rv.SetMapIndex(key, l.goArg(v, rv.Type().Elem(), 3))
+		}
+	case reflect.Slice, reflect.Array:
+		i, ok := sliceIndex(rv, k)
+		if !ok {
+			panic(fmt.Errorf("index out of range: %v", toString(k)))
+		}
+		e := rv.Index(i)
+		if !e.CanSet() {
+			panic(fmt.Errorf("cannot assign to element of %v, use a pointer", gt.t))
+		}
+		e.Set(l.goArg(v, e.Type(), 3))
+	default:
+		panic(fmt.Errorf("attempt to index a %v value", gt.t))
+	}
+	return 0
+}
+
+func (gt *goType) len(l *State) int {
+	switch rv := elem(gt.self(l)); rv.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Chan, reflect.String:
+		l.stack.Push(int64(rv.Len()))
+	default:
+		panic(fmt.Errorf("attempt to get length of a %v value", gt.t))
+	}
+	return 1
+}
+
+func (gt *goType) pairs(l *State) int {
+	rv := elem(gt.self(l))
+	var next func() (reflect.Value, reflect.Value, bool)
+	switch rv.Kind() {
+	case reflect.Map:
+		iter := rv.MapRange()
+		next = func() (reflect.Value, reflect.Value, bool) {
+			if !iter.Next() {
+				return reflect.Value{}, reflect.Value{}, false
+			}
+			return iter.Key(), iter.Value(), true
+		}
+	case reflect.Slice, reflect.Array:
+		i := 0
+		next = func() (reflect.Value, reflect.Value, bool) {
+			if i >= rv.Len() {
+				return reflect.Value{}, reflect.Value{}, false
+			}
+			i++
+			return reflect.ValueOf(i), rv.Index(i - 1), true
+		}
+	case reflect.Struct:
+		fields := reflect.VisibleFields(rv.Type())
+		i := 0
+		next = func() (reflect.Value, reflect.Value, bool) {
+			for ; i < len(fields); i++ {
+				if f := fields[i]; f.IsExported() && !f.Anonymous {
+					if v, err := rv.FieldByIndexErr(f.Index); err == nil {
+						i++
+						return reflect.ValueOf(f.Name), v, true
+					}
+				}
+			}
+			return reflect.Value{}, reflect.Value{}, false
+		}
+	default:
+		panic(fmt.Errorf("attempt to iterate a %v value", gt.t))
+	}
+	l.Push(func(l *State) int {
+		k, v, ok := next()
+		if !ok {
+			l.stack.Push(nil)
+			return 1
+		}
+		l.pushGo(k)
+		l.pushGo(v)
+		return 2
+	})
+	return 1
+}
+
+func (gt *goType) call(l *State) int {
+	return l.callGo(gt.self(l), 2, "function")
+}
+
+// method returns the function of the method name, or nil if there is no such method.
+func (gt *goType) method(l *State, name string) value {
+	if f, ok := gt.methods[name]; ok {
+		return f
+	}
+	m, ok := gt.t.MethodByName(name)
+	if !ok {
+		return nil
+	}
+	l.Push(func(l *State) int {
+		return l.callGo(m.Func, 1, name)
+	})
+	f := l.stack.Get(-1)
+	l.stack.Pop(1)
+	gt.methods[name] = f
+	return f
+}
+
+// callGo calls the Go function fn with the arguments from the given index, and pushes its results.
+// Missing arguments are nil and extra arguments are ignored, like in Lua.
+func (l *State) callGo(fn reflect.Value, first int, name string) int {
+	t := fn.Type()
+	top := l.AbsIndex(-1)
+	arg := func(i int, pt reflect.Type) reflect.Value {
+		var v value
+		if i <= top {
+			v = l.get(i)
+		}
+		rv, err := l.toGo(v, pt)
+		if err != nil {
+			panic(fmt.Errorf("bad argument #%v to '%v' (%v)", i, name, err))
+		}
+		return rv
+	}
+
+	nin := t.NumIn()
+	if t.IsVariadic() {
+		nin--
+	}
+	args := make([]reflect.Value, 0, nin)
+	for i := 0; i < nin; i++ {
+		args = append(args, arg(first+i, t.In(i)))
+	}
+	if t.IsVariadic() {
+		for i := first + nin; i <= top; i++ {
+			args = append(args, arg(i, t.In(nin).Elem()))
+		}
+	}
+
+	out := fn.Call(args)
+	nr := len(out)
+	if nr > 0 && t.Out(nr-1) == errorType {
+		if err := out[nr-1]; !err.IsNil() {
+			l.stack.Push(nil)
+			l.stack.Push(err.Interface().(error).Error())
+			return 2
+		}
+		nr--
+	}
+	for _, v := range out[:nr] {
+		l.pushGo(v)
+	}
+	return nr
+}
+
+// goArg converts an argument for a field, key or element, and raises an error if that is not possible.
+func (l *State) goArg(v value, t reflect.Type, i int) reflect.Value {
+	rv, err := l.toGo(v, t)
+	if err != nil {
+		panic(fmt.Errorf("bad argument #%v (%v)", i, err))
+	}
+	return rv
+}
+
+// toGo converts the Lua value v to a Go value of type t, see ToGo.
+func (l *State) toGo(v value, t reflect.Type) (reflect.Value, error) {
+	rv := reflect.New(t).Elem()
+	if err := l.decode(v, rv, "", 0); err != nil {
+		return reflect.Value{}, err
+	}
+	return rv, nil
+}
+
+// goTypeName returns the Lua type name of v, or the Go type of a userdata.
+func goTypeName(v value) string {
+	if u, ok := v.(*userdata); ok {
+		return fmt.Sprintf("%T", u.data)
+	}
+	return typeOf(v).String()
+}
+
+// field returns the exported field k of the struct rv.
+func field(rv reflect.Value, k value) reflect.Value {
+	name, ok := k.(string)
+	if ok {
+		if f, found := rv.Type().FieldByName(name); found && f.IsExported() {
+			v, err := rv.FieldByIndexErr(f.Index)
+			if err != nil {
+				panic(err)
+			}
+			return v
+		}
+	}
+	panic(fmt.Errorf("%v has no field or method %v", rv.Type(), toString(k)))
+}
+
+// sliceIndex converts the 1-based Lua index k to an index of rv.
+func sliceIndex(rv reflect.Value, k value) (int, bool) {
+	i, err := tryInteger(k)
+	if err != nil || i < 1 || i > int64(rv.Len()) {
+		return 0, false
+	}
+	return int(i - 1), true
+}
+
+func goEqual(l *State) int {
+	a, oka := l.get(1).(*userdata)
+	b, okb := l.get(2).(*userdata)
+	eq := false
+	if oka && okb {
+		ta, tb := reflect.TypeOf(a.data), reflect.TypeOf(b.data)
+		eq = ta == tb && ta.Comparable() && a.data == b.data
+	}
+	l.stack.Push(eq)
+	return 1
+}
+
+func goString(l *State) int {
+	if u, ok := l.get(1).(*userdata); ok {
+		l.stack.Push(fmt.Sprint(u.data))
+	} else {
+		l.stack.Push(toString(l.get(1)))
+	}
+	return 1
+}
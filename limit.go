@@ -0,0 +1,121 @@
+/*
+Copyright 2019 by ofunc
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrInstructionLimit is raised when a State executes more instructions than allowed by SetInstructionLimit.
+var ErrInstructionLimit = errors.New("instruction limit exceeded")
+
+// The number of instructions between two checks of the context.
+const checkInterval = 1024
+
+// SetContext sets the context of the State and all of its coroutines.
+// When the context is done, the running Lua code raises ctx.Err() as an error,
+// which can be recognized with errors.Is after PCall returns.
+// The error is raised again on every check until the context is replaced, so Lua code can't ignore it.
+// The suspended coroutines are closed when the context is done, see Close.
+func (l *State) SetContext(ctx context.Context) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if l.stopClose != nil {
+		l.stopClose()
+		l.stopClose = nil
+	}
+	if ctx.Done() != nil {
+		g := l.globalState
+		l.stopClose = context.AfterFunc(ctx, func() {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			g.closeCoroutines()
+		})
+	}
+	l.ctx = ctx
+	l.done = ctx.Done()
+	l.steps += l.period - l.count
+	l.resetCount()
+}
+
+// Context returns the context of the State.
+// Blocking native functions should give up when it is done.
+func (l *State) Context() context.Context {
+	return l.ctx
+}
+
+// SetInstructionLimit limits the State and all of its coroutines to execute at most n more Lua instructions.
+// When the limit is exceeded ErrInstructionLimit is raised, and raised again on every following instruction
+// until the limit is reset. Set n to 0 to remove the limit.
+func (l *State) SetInstructionLimit(n int64) {
+	if n < 0 {
+		n = 0
+	}
+	l.limit = n
+	l.steps = 0
+	l.resetCount()
+}
+
+// checkLimits is called by the exec loop every period instructions, just before executing the last one.
+// It also calls the line and count hooks.
+func (l *State) checkLimits() {
+	l.steps += l.period
+	if l.done != nil {
+		select {
+		case <-l.done:
+			l.period, l.count = 1, 1
+			panic(l.ctx.Err())
+		default:
+		}
+	}
+	if l.limit > 0 && l.steps > l.limit {
+		l.period, l.count = 1, 1
+		panic(ErrInstructionLimit)
+	}
+	if l.hookMask&(MaskLine|MaskCount) != 0 {
+		l.stepHook()
+	}
+	l.resetCount()
+}
+
+// resetCount starts a new period, so the next check happens in time for the context, the limit and the hooks.
+func (l *State) resetCount() {
+	n := int64(checkInterval)
+	if l.limit > 0 {
+		if r := l.limit - l.steps + 1; r < n {
+			n = r
+		}
+	}
+	if l.hookMask&MaskLine != 0 {
+		n = 1
+	}
+	if l.hookMask&MaskCount != 0 && l.hookLeft < n {
+		n = l.hookLeft
+	}
+	if n < 1 {
+		n = 1
+	}
+	l.period, l.count = n, n
+}
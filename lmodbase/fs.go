@@ -0,0 +1,174 @@
+/*
+Copyright 2019 by ofunc
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lmodbase
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ofunc/lua"
+)
+
+// roots is the file systems of a State, see AddFS.
+type roots struct {
+	list []fs.FS
+}
+
+// AddFS adds the file system fsys, like an embed.FS or a zip.Reader, to the State l.
+// require looks for modules in the file systems after package.path, in the order they were added,
+// and util.Run looks for scripts only in them if there are any.
+func AddFS(l *lua.State, fsys fs.FS) {
+	rs := getRoots(l)
+	if rs == nil {
+		rs = &roots{}
+		l.Push("_FS")
+		l.Push(rs)
+		l.SetTableRaw(lua.RegistryIndex)
+	}
+	rs.list = append(rs.list, fsys)
+}
+
+func getRoots(l *lua.State) *roots {
+	l.Push("_FS")
+	l.GetTableRaw(lua.RegistryIndex)
+	rs, _ := l.GetRaw(-1).(*roots)
+	l.Pop(1)
+	return rs
+}
+
+// FindSrc opens the Lua src file p, or p/init.lua if p is a directory, in the file systems of the State l.
+// It returns the file and the path of the file. Without file systems, it opens p with OpenSrc.
+func FindSrc(l *lua.State, p string) (io.ReadCloser, string, error) {
+	r, _, name, err := findSrc(l, p)
+	return r, name, err
+}
+
+// findSrc is FindSrc, it also returns the file system of the file, nil for OpenSrc.
+func findSrc(l *lua.State, p string) (io.ReadCloser, fs.FS, string, error) {
+	rs := getRoots(l)
+	if rs == nil || len(rs.list) == 0 {
+		r, err := OpenSrc(p)
+		return r, nil, p, err
+	}
+	p = strings.TrimPrefix(path.Clean(filepath.ToSlash(p)), "/")
+	for _, fsys := range rs.list {
+		if info, err := fs.Stat(fsys, p); err == nil && info.IsDir() {
+			if f, err := fsys.Open(path.Join(p, "init.lua")); err == nil {
+				return f, fsys, path.Join(p, "init.lua"), nil
+			}
+		} else if f, err := fsys.Open(p); err == nil {
+			return f, fsys, p, nil
+		}
+	}
+	return nil, nil, p, fmt.Errorf("open %v: %w", p, fs.ErrNotExist)
+}
+
+// LoadSrc loads the Lua src file p, found like FindSrc does, and pushes the result onto the stack.
+// The compiled chunk comes from lua.DefaultCache, if the file didn't change since it was compiled.
+func LoadSrc(l *lua.State, p string) error {
+	r, fsys, name, err := findSrc(l, p)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if fsys == nil {
+		return loadCached(l, r, name, name, modTime(name))
+	}
+	return loadCached(l, r, fsKey(fsys, name), name, time.Time{})
+}
+
+// loadCached loads the Lua src r through lua.DefaultCache, and pushes the result onto the stack.
+// The chunks of file systems have no modification time, so they are read each time,
+// and they are cached by fsKey, since their names are not unique.
+func loadCached(l *lua.State, r io.Reader, key, name string, mtime time.Time) error {
+	p, err := lua.DefaultCache.GetKey(key, name, mtime, func() ([]byte, error) {
+		return io.ReadAll(r)
+	})
+	if err != nil {
+		return err
+	}
+	return l.PushProto(p, 0)
+}
+
+func lsearcherFS(l *lua.State) int {
+	name := l.CheckString(1)
+	rs := getRoots(l)
+	if rs == nil {
+		return 0
+	}
+	base := strings.Replace(name, ".", "/", -1)
+	var msg strings.Builder
+	for i, fsys := range rs.list {
+		for _, p := range []string{base + ".lua", base + "/init.lua"} {
+			f, err := fsys.Open(p)
+			if err != nil {
+				if !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, fs.ErrInvalid) {
+					panic(fmt.Errorf("error loading module '%v' from file '%v':\n\t%v", name, p, err))
+				}
+				fmt.Fprintf(&msg, "\n\tno file '%v' in file system #%v", p, i+1)
+				continue
+			}
+			err = loadCached(l, f, fsKey(fsys, p), p, time.Time{})
+			f.Close()
+			if err != nil {
+				panic(fmt.Errorf("error loading module '%v' from file '%v':\n\t%v", name, p, err))
+			}
+			l.Push(p)
+			return 2
+		}
+	}
+	l.Push(msg.String())
+	return 1
+}
+
+// fsIDs is the ids of the file systems that are compared by value, see fsKey.
+var fsIDs sync.Map
+var fsCount uint64
+
+// fsKey returns the key of the chunk p of the file system fsys in lua.DefaultCache.
+// File systems that are references, like fstest.MapFS or *zip.Reader, are told apart by their address,
+// and other ones, like embed.FS or os.DirFS, by their value if they are comparable.
+func fsKey(fsys fs.FS, p string) string {
+	v := reflect.ValueOf(fsys)
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return fmt.Sprintf("%T@%x:%v", fsys, v.Pointer(), p)
+	}
+	if v.Comparable() {
+		id, ok := fsIDs.Load(fsys)
+		if !ok {
+			id, _ = fsIDs.LoadOrStore(fsys, atomic.AddUint64(&fsCount, 1))
+		}
+		return fmt.Sprintf("%T#%v:%v", fsys, id, p)
+	}
+	return fmt.Sprintf("%T:%v", fsys, p)
+}
@@ -24,7 +24,9 @@ package lmodbase
 
 import (
 	"fmt"
-	"path/filepath"
+	"io"
+	"os"
+	"strings"
 
 	"github.com/ofunc/lua"
 )
@@ -34,7 +36,9 @@ const (
 	Version = "1.1.0"
 )
 
-// The searchpaths for "require".
+// The searchpaths for "require", they are the default package.path of the States opened later.
+//
+// Deprecated: Use SetPaths to set the searchpaths of a State.
 var Paths []string
 
 // Open opens the module.
@@ -57,7 +61,7 @@ func Open(l *lua.State) int {
 	l.SetTableRaw(lua.GlobalsIndex)
 
 	l.Push("require")
-	l.Push(lrequire)
+	openPackage(l)
 	l.SetTableRaw(lua.GlobalsIndex)
 
 	l.Push("assert")
@@ -76,6 +80,14 @@ func Open(l *lua.State) int {
 	l.Push(lipairs)
 	l.SetTableRaw(lua.GlobalsIndex)
 
+	l.Push("load")
+	l.Push(lload)
+	l.SetTableRaw(lua.GlobalsIndex)
+
+	l.Push("next")
+	l.Push(lnext)
+	l.SetTableRaw(lua.GlobalsIndex)
+
 	l.Push("pairs")
 	l.Push(lpairs)
 	l.SetTableRaw(lua.GlobalsIndex)
@@ -124,70 +136,23 @@ func Open(l *lua.State) int {
 	l.Push(ltype)
 	l.SetTableRaw(lua.GlobalsIndex)
 
-	return 0
-}
-
-func lrequire(l *lua.State) int {
-	l.Push("_LOADED")
-	l.GetTableRaw(lua.RegistryIndex)
-	loaded := l.AbsIndex(-1)
-	l.PushIndex(1)
-	if l.GetTableRaw(loaded) != lua.TypeNil {
-		return 1
-	}
-
-	l.Push("_PRELOAD")
-	l.GetTableRaw(lua.RegistryIndex)
-	l.PushIndex(1)
-	if l.GetTableRaw(-2) == lua.TypeFunction {
-		l.PushIndex(1)
-		l.Call(1, 1)
-		if l.IsNil(-1) {
-			l.Push(true)
-		} else {
-			l.PushIndex(-1)
-		}
-		l.PushIndex(1)
-		l.PushIndex(-2)
-		l.SetTableRaw(loaded)
-		return 1
-	}
+	l.Push("xpcall")
+	l.Push(lxpcall)
+	l.SetTableRaw(lua.GlobalsIndex)
 
-	name := l.ToString(1)
-	for _, p := range Paths {
-		p = filepath.Join(p, name)
-		r, err := OpenSrc(p + ".lua")
-		if err != nil {
-			r, err = OpenSrc(p + "/init.lua")
-			if err != nil {
-				continue
-			}
-		}
-		if err := l.LoadText(r, name, 0); err != nil {
-			panic(err)
-			return 0
-		}
-		l.Call(0, 1)
-		r.Close()
-		if l.IsNil(-1) {
-			l.Push(true)
-		} else {
-			l.PushIndex(-1)
-		}
-		l.PushIndex(1)
-		l.PushIndex(-2)
-		l.SetTableRaw(loaded)
-		return 1
-	}
-	panic("require: module '" + name + "' not found")
+	return 0
 }
 
 func lassert(l *lua.State) int {
+	l.CheckAny(1)
 	if l.ToBoolean(1) {
 		return l.AbsIndex(-1)
-	} else {
-		panic(l.OptString(2, "assertion failed!"))
+	} else if l.IsNil(2) {
+		panic("assertion failed!")
 	}
+	l.PushIndex(2)
+	l.Error()
+	return 0
 }
 
 func lerror(l *lua.State) int {
@@ -196,6 +161,7 @@ func lerror(l *lua.State) int {
 }
 
 func lgetmetatable(l *lua.State) int {
+	l.CheckAny(1)
 	if l.GetMetaField(1, "__metatable") == lua.TypeNil {
 		if l.GetMetaTable(1) {
 			return 1
@@ -208,6 +174,7 @@ func lgetmetatable(l *lua.State) int {
 }
 
 func lipairs(l *lua.State) int {
+	l.CheckAny(1)
 	l.Push(func(l *lua.State) int {
 		i := l.ToInteger(2) + 1
 		l.Push(i)
@@ -223,9 +190,91 @@ func lipairs(l *lua.State) int {
 	return 3
 }
 
+func lload(l *lua.State) int {
+	allowed := l.LoadMode()
+	if allowed == "" {
+		panic("load: disabled by the host")
+	}
+
+	var chunk string
+	name := "=(load)"
+	if l.TypeOf(1) == lua.TypeString {
+		chunk = l.ToString(1)
+		name = chunk
+	} else {
+		l.CheckType(1, lua.TypeFunction)
+		var b strings.Builder
+		for {
+			l.PushIndex(1)
+			l.Call(0, 1)
+			if l.IsNil(-1) {
+				break
+			}
+			if l.TypeOf(-1) != lua.TypeString {
+				l.Push(nil)
+				l.Push("reader function must return a string")
+				return 2
+			}
+			s := l.ToString(-1)
+			l.Pop(1)
+			if s == "" {
+				break
+			}
+			l.Alloc(int64(len(s)))
+			b.WriteString(s)
+		}
+		chunk = b.String()
+	}
+	name = l.OptString(2, name)
+	mode := l.OptString(3, "bt")
+	env := 0
+	if l.AbsIndex(-1) >= 4 {
+		// An explicit nil is the environment, like in the reference implementation.
+		if !l.IsNil(4) {
+			l.CheckTable(4)
+		}
+		env = 4
+	}
+
+	kind, c := "text", "t"
+	if strings.HasPrefix(chunk, "\x1b") {
+		kind, c = "binary", "b"
+	}
+	var err error
+	if !strings.Contains(mode, c) {
+		err = fmt.Errorf("attempt to load a %v chunk (mode is '%v')", kind, mode)
+	} else if !strings.Contains(allowed, c) {
+		err = fmt.Errorf("attempt to load a %v chunk (mode of the host is '%v')", kind, allowed)
+	} else if c == "b" {
+		err = l.LoadBinary(strings.NewReader(chunk), name, env)
+	} else {
+		err = l.LoadText(strings.NewReader(chunk), name, env)
+	}
+	if err != nil {
+		l.Push(nil)
+		l.Push(err.Error())
+		return 2
+	}
+	return 1
+}
+
+func lnext(l *lua.State) int {
+	l.CheckTable(1)
+	if l.AbsIndex(-1) < 2 {
+		l.Push(nil)
+	}
+	l.PushIndex(2)
+	if l.Next(1) {
+		return 2
+	}
+	l.Push(nil)
+	return 1
+}
+
 func lpairs(l *lua.State) int {
 	if l.GetMetaField(1, "__pairs") == lua.TypeNil {
-		l.GetIter(1)
+		l.CheckTable(1)
+		l.Push(lnext)
 		l.PushIndex(1)
 		l.Push(nil)
 	} else {
@@ -236,6 +285,7 @@ func lpairs(l *lua.State) int {
 }
 
 func lpcall(l *lua.State) int {
+	l.CheckAny(1)
 	if msg := l.PCall(l.AbsIndex(-1)-1, -1, false); msg == nil {
 		l.Push(true)
 		n := l.AbsIndex(-1)
@@ -255,34 +305,63 @@ func lpcall(l *lua.State) int {
 }
 
 func lprint(l *lua.State) int {
+	w := output(l)
 	n := l.AbsIndex(-1)
 	for i := 1; i <= n; i++ {
-		fmt.Print(l.ToString(i))
+		fmt.Fprint(w, l.ToString(i))
 		if i < n {
-			fmt.Print("\t")
+			fmt.Fprint(w, "\t")
 		}
 	}
-	fmt.Println()
+	fmt.Fprintln(w)
 	return 0
 }
 
+// SetOutput sets the output of print in the State l, nil for os.Stdout.
+func SetOutput(l *lua.State, w io.Writer) {
+	l.Push("_PRINT")
+	l.Push(&w)
+	l.SetTableRaw(lua.RegistryIndex)
+}
+
+func output(l *lua.State) io.Writer {
+	l.Push("_PRINT")
+	l.GetTableRaw(lua.RegistryIndex)
+	w, ok := l.GetRaw(-1).(*io.Writer)
+	l.Pop(1)
+	if !ok || *w == nil {
+		return os.Stdout
+	}
+	return *w
+}
+
 func lrawequal(l *lua.State) int {
+	l.CheckAny(1)
+	l.CheckAny(2)
 	l.Push(l.CompareRaw(1, 2, lua.OpEqual))
 	return 1
 }
 
 func lrawget(l *lua.State) int {
+	l.CheckTable(1)
+	l.CheckAny(2)
 	l.PushIndex(2)
 	l.GetTableRaw(1)
 	return 1
 }
 
 func lrawlen(l *lua.State) int {
+	if t := l.TypeOf(1); t != lua.TypeTable && t != lua.TypeString {
+		l.TypeError(1, "table or string")
+	}
 	l.Push(l.LengthRaw(1))
 	return 1
 }
 
 func lrawset(l *lua.State) int {
+	l.CheckTable(1)
+	l.CheckAny(2)
+	l.CheckAny(3)
 	l.PushIndex(2)
 	l.PushIndex(3)
 	l.SetTableRaw(1)
@@ -296,17 +375,24 @@ func lselect(l *lua.State) int {
 		l.Push(n - 1)
 		return 1
 	} else {
-		if i := int(l.ToInteger(1)); i > 0 {
+		if i := int(l.CheckInteger(1)); i >= n {
+			return 0
+		} else if i > 0 {
 			return n - i
 		} else if i < 0 && i > -n {
 			return -i
 		} else {
-			panic("select: index out of range")
+			l.ArgError(1, "index out of range")
+			return 0
 		}
 	}
 }
 
 func lsetmetatable(l *lua.State) int {
+	l.CheckTable(1)
+	if t := l.TypeOf(2); t != lua.TypeNil && t != lua.TypeTable {
+		l.TypeError(2, "nil or table")
+	}
 	if l.GetMetaField(1, "__metatable") == lua.TypeNil {
 		l.PushIndex(2)
 		l.SetMetaTable(1)
@@ -318,6 +404,7 @@ func lsetmetatable(l *lua.State) int {
 }
 
 func ltonumber(l *lua.State) int {
+	l.CheckAny(1)
 	if v, err := l.TryInteger(1); err == nil {
 		l.Push(v)
 	} else if v, err := l.TryFloat(1); err == nil {
@@ -329,11 +416,36 @@ func ltonumber(l *lua.State) int {
 }
 
 func ltostring(l *lua.State) int {
+	l.CheckAny(1)
 	l.Push(l.ToString(1))
 	return 1
 }
 
 func ltype(l *lua.State) int {
+	l.CheckAny(1)
 	l.Push(l.TypeOf(1).String())
 	return 1
 }
+
+func lxpcall(l *lua.State) int {
+	n := l.AbsIndex(-1)
+	l.CheckAny(2)
+	l.PushIndex(1)
+	l.Set(1, 2)
+	l.Set(2, -1)
+	l.Pop(1)
+	if msg := l.PCallHandler(n-2, -1, 1); msg == nil {
+		l.Push(true)
+		l.Set(1, -1)
+		l.Pop(1)
+		return l.AbsIndex(-1)
+	} else {
+		l.Push(false)
+		if err, ok := msg.(error); ok {
+			l.Push(err.Error())
+		} else {
+			l.Push(msg)
+		}
+		return 2
+	}
+}
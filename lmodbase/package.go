@@ -0,0 +1,268 @@
+/*
+Copyright 2019 by ofunc
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lmodbase
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/ofunc/lua"
+	"github.com/ofunc/lua/lmodos"
+)
+
+// The directory separator, the path separator, the substitution mark, the executable directory mark,
+// and the mark to ignore all before it when building the luaopen_ function names.
+var config = string(filepath.Separator) + "\n;\n?\n!\n-\n"
+
+// openPackage creates the package table, and pushes require, a closure of it.
+func openPackage(l *lua.State) {
+	l.NewTable(0, 8)
+	pkg := l.AbsIndex(-1)
+
+	l.Push("config")
+	l.Push(config)
+	l.SetTableRaw(pkg)
+
+	l.Push("loaded")
+	l.Push("_LOADED")
+	l.GetTableRaw(lua.RegistryIndex)
+	l.SetTableRaw(pkg)
+
+	l.Push("path")
+	l.Push(defaultPath())
+	l.SetTableRaw(pkg)
+
+	l.Push("preload")
+	l.Push("_PRELOAD")
+	l.GetTableRaw(lua.RegistryIndex)
+	l.SetTableRaw(pkg)
+
+	l.Push("searchers")
+	l.NewTable(4, 0)
+	l.Push(1)
+	l.PushClosure(lsearcherPreload, pkg)
+	l.SetTableRaw(-3)
+	l.Push(2)
+	l.PushClosure(lsearcherLua, pkg)
+	l.SetTableRaw(-3)
+	l.Push(3)
+	l.Push(lsearcherFS)
+	l.SetTableRaw(-3)
+	l.SetTableRaw(pkg)
+
+	l.Push("searchpath")
+	l.Push(lsearchpath)
+	l.SetTableRaw(pkg)
+
+	l.Push("_PACKAGE")
+	l.PushIndex(pkg)
+	l.SetTableRaw(lua.RegistryIndex)
+
+	l.Push("_LOADED")
+	l.GetTableRaw(lua.RegistryIndex)
+	l.Push("package")
+	l.PushIndex(pkg)
+	l.SetTableRaw(-3)
+	l.Pop(1)
+
+	l.PushClosure(lrequire, pkg)
+	l.Insert(pkg)
+	l.Pop(1)
+}
+
+// SetPaths sets the package.path of the State l to the templates for the searchpaths,
+// so require looks for the module m in path/m.lua and path/m/init.lua for each path.
+// The base module must be open.
+func SetPaths(l *lua.State, paths []string) {
+	l.Push("_PACKAGE")
+	l.GetTableRaw(lua.RegistryIndex)
+	l.Push("path")
+	l.Push(pathOf(paths))
+	l.SetTable(-3)
+	l.Pop(1)
+}
+
+// defaultPath returns the templates of package.path for the searchpaths in Paths.
+func defaultPath() string {
+	return pathOf(Paths)
+}
+
+// pathOf returns the templates of package.path for the searchpaths.
+func pathOf(paths []string) string {
+	xs := make([]string, 0, 2*len(paths))
+	for _, p := range paths {
+		xs = append(xs, filepath.Join(p, "?.lua"), filepath.Join(p, "?", "init.lua"))
+	}
+	return strings.Join(xs, ";")
+}
+
+// AddSearcher appends the searcher f to package.searchers, so require tries it after the searchers before it.
+// Like the searchers written in Lua, f is called with the name of the module,
+// and returns a loader function and a value that is passed to the loader,
+// or a string that explains why it didn't find the module.
+func AddSearcher(l *lua.State, f func(*lua.State) int) {
+	l.Push("_PACKAGE")
+	l.GetTableRaw(lua.RegistryIndex)
+	l.Push("searchers")
+	if l.GetTable(-2) != lua.TypeTable {
+		panic("'package.searchers' must be a table")
+	}
+	l.Push(l.Length(-1) + 1)
+	l.Push(f)
+	l.SetTable(-3)
+	l.Pop(2)
+}
+
+func lrequire(l *lua.State) int {
+	name := l.CheckString(1)
+	l.Push("_LOADED")
+	l.GetTableRaw(lua.RegistryIndex)
+	loaded := l.AbsIndex(-1)
+	l.PushIndex(1)
+	if l.GetTableRaw(loaded); l.ToBoolean(-1) {
+		return 1
+	}
+	l.Pop(1)
+
+	l.PushIndex(lua.FirstUpVal - 1)
+	l.Push("searchers")
+	if l.GetTable(-2) != lua.TypeTable {
+		panic("'package.searchers' must be a table")
+	}
+	searchers := l.AbsIndex(-1)
+	var msg strings.Builder
+	for i := 1; ; i++ {
+		l.Push(i)
+		if l.GetTableRaw(searchers) == lua.TypeNil {
+			panic("module '" + name + "' not found:" + msg.String())
+		}
+		l.PushIndex(1)
+		l.Call(1, 2)
+		if l.TypeOf(-2) == lua.TypeFunction {
+			break
+		}
+		if l.TypeOf(-2) == lua.TypeString {
+			msg.WriteString(l.ToString(-2))
+		}
+		l.Pop(2)
+	}
+
+	// The loader and its data are on the top of the stack.
+	l.PushIndex(-2)
+	l.PushIndex(1)
+	l.PushIndex(-3)
+	l.Call(2, 1)
+	if !l.IsNil(-1) {
+		l.PushIndex(1)
+		l.PushIndex(-2)
+		l.SetTableRaw(loaded)
+	}
+	l.PushIndex(1)
+	if l.GetTableRaw(loaded) == lua.TypeNil {
+		l.PushIndex(1)
+		l.Push(true)
+		l.SetTableRaw(loaded)
+		l.Push(true)
+	}
+	return 1
+}
+
+func lsearcherPreload(l *lua.State) int {
+	name := l.CheckString(1)
+	l.PushIndex(lua.FirstUpVal - 1)
+	l.Push("preload")
+	if l.GetTable(-2) != lua.TypeTable {
+		panic("'package.preload' must be a table")
+	}
+	l.PushIndex(1)
+	if l.GetTable(-2) == lua.TypeNil {
+		l.Push("\n\tno field package.preload['" + name + "']")
+		return 1
+	}
+	l.Push(":preload:")
+	return 2
+}
+
+func lsearcherLua(l *lua.State) int {
+	name := l.CheckString(1)
+	l.PushIndex(lua.FirstUpVal - 1)
+	l.Push("path")
+	if l.GetTable(-2) != lua.TypeString {
+		panic("'package.path' must be a string")
+	}
+	p, msg := searchPath(name, l.ToString(-1), ".", string(filepath.Separator))
+	if p == "" {
+		l.Push(msg)
+		return 1
+	}
+
+	r, err := OpenSrc(p)
+	if err == nil {
+		err = loadCached(l, r, p, p, modTime(p))
+		r.Close()
+	}
+	if err != nil {
+		panic(fmt.Errorf("error loading module '%v' from file '%v':\n\t%v", name, p, err))
+	}
+	l.Push(p)
+	return 2
+}
+
+func lsearchpath(l *lua.State) int {
+	name := l.CheckString(1)
+	path := l.CheckString(2)
+	sep := l.OptString(3, ".")
+	rep := l.OptString(4, string(filepath.Separator))
+	// The search probes the file system for any path that the script gives.
+	lmodos.CheckAccess(l, lmodos.ReadOnly)
+	if p, msg := searchPath(name, path, sep, rep); p != "" {
+		l.Push(p)
+		return 1
+	} else {
+		l.Push(nil)
+		l.Push(msg)
+		return 2
+	}
+}
+
+// searchPath returns the first file that can be opened for the module name in the templates of path,
+// or a message with the files that were tried.
+func searchPath(name, path, sep, rep string) (string, string) {
+	if sep != "" {
+		name = strings.Replace(name, sep, rep, -1)
+	}
+	var msg strings.Builder
+	for _, t := range strings.Split(path, ";") {
+		if t == "" {
+			continue
+		}
+		p := strings.Replace(t, "?", name, -1)
+		if r, err := OpenSrc(p); err == nil {
+			r.Close()
+			return p, ""
+		}
+		msg.WriteString("\n\tno file '" + p + "'")
+	}
+	return "", msg.String()
+}
@@ -27,9 +27,18 @@ package lmodbase
 import (
 	"io"
 	"os"
+	"time"
 )
 
 // OpenSrc opens the Lua src file.
 func OpenSrc(p string) (io.ReadCloser, error) {
 	return os.Open(p)
 }
+
+// modTime returns the modification time of the Lua src file, or the zero time if it is unknown.
+func modTime(p string) time.Time {
+	if info, err := os.Stat(p); err == nil {
+		return info.ModTime()
+	}
+	return time.Time{}
+}
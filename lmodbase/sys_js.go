@@ -31,6 +31,7 @@ import (
 	"strings"
 	"sync"
 	"syscall/js"
+	"time"
 )
 
 // OpenSrc opens the Lua src file.
@@ -63,3 +64,8 @@ func OpenSrc(p string) (r io.ReadCloser, e error) {
 	wg.Wait()
 	return
 }
+
+// modTime returns the modification time of the Lua src file, or the zero time if it is unknown.
+func modTime(p string) time.Time {
+	return time.Time{}
+}
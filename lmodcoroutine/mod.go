@@ -0,0 +1,137 @@
+/*
+Copyright 2019 by ofunc
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lmodcoroutine
+
+import (
+	"github.com/ofunc/lua"
+)
+
+// Open opens the module.
+func Open(l *lua.State) int {
+	l.NewTable(0, 8)
+
+	l.Push("close")
+	l.Push(lclose)
+	l.SetTableRaw(-3)
+
+	l.Push("create")
+	l.Push(lcreate)
+	l.SetTableRaw(-3)
+
+	l.Push("isyieldable")
+	l.Push(lisyieldable)
+	l.SetTableRaw(-3)
+
+	l.Push("resume")
+	l.Push(lresume)
+	l.SetTableRaw(-3)
+
+	l.Push("running")
+	l.Push(lrunning)
+	l.SetTableRaw(-3)
+
+	l.Push("status")
+	l.Push(lstatus)
+	l.SetTableRaw(-3)
+
+	l.Push("wrap")
+	l.Push(lwrap)
+	l.SetTableRaw(-3)
+
+	l.Push("yield")
+	l.Push(lyield)
+	l.SetTableRaw(-3)
+
+	return 1
+}
+
+func lclose(l *lua.State) int {
+	l.CheckType(1, lua.TypeThread)
+	if err := l.CloseCoroutine(1); err != nil {
+		panic(err)
+	}
+	l.Push(true)
+	return 1
+}
+
+func lcreate(l *lua.State) int {
+	l.CheckType(1, lua.TypeFunction)
+	l.PushIndex(1)
+	l.NewCoroutine()
+	return 1
+}
+
+func lisyieldable(l *lua.State) int {
+	l.Push(l.IsYieldable())
+	return 1
+}
+
+func lresume(l *lua.State) int {
+	l.CheckType(1, lua.TypeThread)
+	if n, msg := l.Resume(1, l.AbsIndex(-1)-1); msg == nil {
+		l.Push(true)
+		if n > 0 {
+			l.Insert(2)
+		}
+		return n + 1
+	} else {
+		l.Push(false)
+		if err, ok := msg.(error); ok {
+			l.Push(err.Error())
+		} else {
+			l.Push(msg)
+		}
+		return 2
+	}
+}
+
+func lrunning(l *lua.State) int {
+	l.Push(l.PushThread())
+	return 2
+}
+
+func lstatus(l *lua.State) int {
+	l.CheckType(1, lua.TypeThread)
+	l.Push(l.StatusOf(1).String())
+	return 1
+}
+
+func lwrap(l *lua.State) int {
+	l.CheckType(1, lua.TypeFunction)
+	l.PushIndex(1)
+	l.NewCoroutine()
+	l.PushClosure(lwrapped, -1)
+	return 1
+}
+
+func lwrapped(l *lua.State) int {
+	n, msg := l.Resume(lua.FirstUpVal-1, l.AbsIndex(-1))
+	if msg != nil {
+		panic(msg)
+	}
+	return n
+}
+
+func lyield(l *lua.State) int {
+	return l.Yield(l.AbsIndex(-1))
+}
@@ -31,10 +31,13 @@ import (
 	"os"
 
 	"github.com/ofunc/lua"
+	"github.com/ofunc/lua/lmodos"
 )
 
 // Open opens the module.
 func Open(l *lua.State) int {
+	// The standard files share their type with the files of the os module.
+	l.RegisterType("os.File", nil)
 	l.NewTable(0, 16)
 
 	l.Push("buffer")
@@ -93,9 +96,11 @@ func lbuffer(l *lua.State) int {
 }
 
 func lcopy(l *lua.State) int {
-	r := toReader(l, 1)
+	r := ctxReader{l, toReader(l, 1)}
 	w := toWriter(l, 2)
 	n := l.OptInteger(3, -1)
+	checkFile(l, r.r, lmodos.ReadOnly)
+	checkFile(l, w, lmodos.ReadWrite)
 
 	var k int64
 	var err error
@@ -104,70 +109,72 @@ func lcopy(l *lua.State) int {
 	} else {
 		k, err = io.Copy(w, r)
 	}
+	checkContext(l)
 	l.Push(k)
 	l.Push(errmsg(err))
 	return 2
 }
 
 func llimit(l *lua.State) int {
-	n := l.ToInteger(2)
-	l.Push(io.LimitReader(toReader(l, 1), n))
+	n := l.CheckInteger(2)
+	r := toReader(l, 1)
+	checkFile(l, r, lmodos.ReadOnly)
+	l.Push(io.LimitReader(r, n))
 	return 1
 }
 
 func lread(l *lua.State) int {
-	r := toReader(l, 1)
+	r := ctxReader{l, toReader(l, 1)}
 	n := l.OptInteger(2, -1)
+	checkFile(l, r.r, lmodos.ReadOnly)
 
 	var err error
 	var xs []byte
 	if n >= 0 {
 		var k int
+		l.Alloc(n)
 		xs = make([]byte, n)
 		k, err = r.Read(xs)
 		xs = xs[:k]
+	} else if m := l.AllocLimit(); m > 0 {
+		xs, err = ioutil.ReadAll(io.LimitReader(r, m-l.Allocated()+1))
+		l.Alloc(int64(len(xs)))
 	} else {
 		xs, err = ioutil.ReadAll(r)
 	}
+	checkContext(l)
 	l.Push(string(xs))
 	l.Push(errmsg(err))
 	return 2
 }
 
 func lreadfile(l *lua.State) int {
-	xs, err := ioutil.ReadFile(l.ToString(1))
+	lmodos.CheckAccess(l, lmodos.ReadOnly)
+	xs, err := ioutil.ReadFile(l.CheckString(1))
 	l.Push(string(xs))
 	l.Push(errmsg(err))
 	return 2
 }
 
 func lscanner(l *lua.State) int {
-	scanner := bufio.NewScanner(toReader(l, 1))
+	r := toReader(l, 1)
+	checkFile(l, r, lmodos.ReadOnly)
+	scanner := bufio.NewScanner(ctxReader{l, r})
 	var split bufio.SplitFunc
 	switch typ := l.TypeOf(2); typ {
 	case lua.TypeNil:
 		split = bufio.ScanLines
 	case lua.TypeString:
-		switch name := l.ToString(2); name {
-		case "byte":
-			split = bufio.ScanBytes
-		case "line":
-			split = bufio.ScanLines
-		case "rune":
-			split = bufio.ScanRunes
-		case "word":
-			split = bufio.ScanWords
-		default:
-			panic("io.scanner: invalid argument #2: unknown split: " + name)
-		}
-	default:
+		splits := []bufio.SplitFunc{bufio.ScanBytes, bufio.ScanLines, bufio.ScanRunes, bufio.ScanWords}
+		split = splits[l.CheckOption(2, "", []string{"byte", "line", "rune", "word"})]
+	case lua.TypeFunction:
 		split = func(data []byte, atEOF bool) (advance int, token []byte, err error) {
 			l.PushIndex(lua.FirstUpVal - 1)
 			l.Push(string(data))
 			l.Push(atEOF)
 			l.Call(2, 3)
 			advance = int(l.ToInteger(-3))
-			if xs := l.OptString(-2, ""); xs != "" {
+			if xs := l.ToString(-2); !l.IsNil(-2) && xs != "" {
 				token = []byte(xs)
 			}
 			if !l.IsNil(-1) {
@@ -176,13 +183,17 @@ func lscanner(l *lua.State) int {
 			l.Pop(3)
 			return
 		}
+	default:
+		l.TypeError(2, "string or function")
 	}
 	scanner.Split(split)
 	l.PushClosure(func(l *lua.State) int {
+		checkFile(l, r, lmodos.ReadOnly)
 		if scanner.Scan() {
 			l.Push(scanner.Text())
 			return 1
 		} else {
+			checkContext(l)
 			l.Push(nil)
 			l.Push(errmsg(scanner.Err()))
 			return 2
@@ -206,26 +217,30 @@ func ltype(l *lua.State) int {
 }
 
 func lwrite(l *lua.State) int {
-	n, err := toWriter(l, 1).Write([]byte(l.OptString(2, "")))
+	w := toWriter(l, 1)
+	checkFile(l, w, lmodos.ReadWrite)
+	n, err := w.Write([]byte(l.OptString(2, "")))
 	l.Push(n)
 	l.Push(errmsg(err))
 	return 2
 }
 
 func lwritefile(l *lua.State) int {
-	err := ioutil.WriteFile(l.ToString(1), []byte(l.ToString(2)), 0666)
+	lmodos.CheckAccess(l, lmodos.ReadWrite)
+	err := ioutil.WriteFile(l.CheckString(1), []byte(l.CheckString(2)), 0666)
 	l.Push(errmsg(err))
 	return 1
 }
 
 func lindex(l *lua.State) int {
+	o := lmodos.GetOptions(l)
 	switch l.ToString(2) {
 	case "stderr":
-		l.Push(os.Stderr)
+		pushFile(l, o.Stderr)
 	case "stdin":
-		l.Push(os.Stdin)
+		pushFile(l, o.Stdin)
 	case "stdout":
-		l.Push(os.Stdout)
+		pushFile(l, o.Stdout)
 	default:
 		l.Push(nil)
 	}
@@ -233,27 +248,27 @@ func lindex(l *lua.State) int {
 }
 
 func lnewindex(l *lua.State) int {
+	lmodos.CheckStdio(l)
+	var err error
 	switch key := l.ToString(2); key {
-	case "stderr":
-		if f, ok := l.GetRaw(3).(*os.File); ok {
-			os.Stderr = f
-		} else {
-			panic("io.stderr: not a file")
-		}
+	case "stderr", "stdout":
+		err = lmodos.SetStdio(l, key, toWriter(l, 3))
 	case "stdin":
-		if f, ok := l.GetRaw(3).(*os.File); ok {
-			os.Stdin = f
-		} else {
-			panic("io.stdin: not a file")
-		}
-	case "stdout":
-		if f, ok := l.GetRaw(3).(*os.File); ok {
-			os.Stdout = f
-		} else {
-			panic("io.stdout: not a file")
-		}
+		err = lmodos.SetStdio(l, key, toReader(l, 3))
 	default:
 		panic("io: invalid field: " + key)
 	}
+	if err != nil {
+		panic(err)
+	}
 	return 0
 }
+
+// pushFile pushes a standard file, *os.File values get the os.File type.
+func pushFile(l *lua.State, f interface{}) {
+	if x, ok := f.(*os.File); ok {
+		l.PushUserData(x, "os.File")
+	} else {
+		l.Push(f)
+	}
+}
@@ -23,25 +23,43 @@ misrepresented as being the original software.
 package lmodio
 
 import (
+	"context"
+	"errors"
 	"io"
+	"os"
+	"time"
 
 	"github.com/ofunc/lua"
+	"github.com/ofunc/lua/lmodos"
 )
 
 func toReader(l *lua.State, i int) io.Reader {
 	if r, ok := l.GetRaw(i).(io.Reader); ok {
 		return r
-	} else {
-		panic("io: not a reader: " + l.ToString(i))
 	}
+	l.TypeError(i, "reader")
+	return nil
 }
 
 func toWriter(l *lua.State, i int) io.Writer {
 	if w, ok := l.GetRaw(i).(io.Writer); ok {
 		return w
-	} else {
-		panic("io: not a writer: " + l.ToString(i))
 	}
+	l.TypeError(i, "writer")
+	return nil
+}
+
+// checkFile raises an error if the policy of the State doesn't allow using f with the access a,
+// see lmodos.CheckFile. The readers made by io.limit are checked with the reader that they read from.
+func checkFile(l *lua.State, f interface{}, a lmodos.Access) {
+	for {
+		r, ok := f.(*io.LimitedReader)
+		if !ok {
+			break
+		}
+		f = r.R
+	}
+	lmodos.CheckFile(l, f, a)
 }
 
 func errmsg(err error) interface{} {
@@ -53,3 +71,41 @@ func errmsg(err error) interface{} {
 		return err.Error()
 	}
 }
+
+// ctxReader is a reader that is interrupted when the context of the State is done.
+// Only readers with a read deadline, like pipes and network connections, can be interrupted while blocked.
+type ctxReader struct {
+	l *lua.State
+	r io.Reader
+}
+
+// Read reads up to len(xs) bytes from the reader.
+func (r ctxReader) Read(xs []byte) (int, error) {
+	ctx := r.l.Context()
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	d, ok := r.r.(interface{ SetReadDeadline(time.Time) error })
+	if !ok || ctx.Done() == nil {
+		return r.r.Read(xs)
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		d.SetReadDeadline(time.Now())
+	})
+	n, err := r.r.Read(xs)
+	if !stop() {
+		d.SetReadDeadline(time.Time{})
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			err = ctx.Err()
+		}
+	}
+	return n, err
+}
+
+// checkContext raises the error of the context of the State, if it is done.
+func checkContext(l *lua.State) {
+	if err := l.Context().Err(); err != nil {
+		panic(err)
+	}
+}
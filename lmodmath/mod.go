@@ -25,14 +25,17 @@ package lmodmath
 import (
 	"math"
 	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/ofunc/lua"
 )
 
-func init() {
-	rand.Seed(time.Now().Unix())
-}
+// The global source of math/rand can't be seeded since Go 1.24, so the module has its own.
+var (
+	rmu sync.Mutex
+	rnd = rand.New(rand.NewSource(time.Now().Unix()))
+)
 
 // Open opens the module.
 func Open(l *lua.State) int {
@@ -161,30 +164,30 @@ func labs(l *lua.State) int {
 			l.Push(-v)
 		}
 	} else {
-		l.Push(math.Abs(l.ToFloat(1)))
+		l.Push(math.Abs(l.CheckNumber(1)))
 	}
 	return 1
 }
 
 func lacos(l *lua.State) int {
-	l.Push(math.Acos(l.ToFloat(1)))
+	l.Push(math.Acos(l.CheckNumber(1)))
 	return 1
 }
 
 func lasin(l *lua.State) int {
-	l.Push(math.Asin(l.ToFloat(1)))
+	l.Push(math.Asin(l.CheckNumber(1)))
 	return 1
 }
 
 func latan(l *lua.State) int {
-	x := l.ToFloat(1)
+	x := l.CheckNumber(1)
 	y := l.OptFloat(2, 1)
 	l.Push(math.Atan2(x, y))
 	return 1
 }
 
 func lceil(l *lua.State) int {
-	v := math.Ceil(l.ToFloat(1))
+	v := math.Ceil(l.CheckNumber(1))
 	x := int64(v)
 	if float64(x) == v {
 		l.Push(x)
@@ -195,22 +198,22 @@ func lceil(l *lua.State) int {
 }
 
 func lcos(l *lua.State) int {
-	l.Push(math.Cos(l.ToFloat(1)))
+	l.Push(math.Cos(l.CheckNumber(1)))
 	return 1
 }
 
 func ldeg(l *lua.State) int {
-	l.Push(180 * l.ToFloat(1) / math.Pi)
+	l.Push(180 * l.CheckNumber(1) / math.Pi)
 	return 1
 }
 
 func lexp(l *lua.State) int {
-	l.Push(math.Exp(l.ToFloat(1)))
+	l.Push(math.Exp(l.CheckNumber(1)))
 	return 1
 }
 
 func lfloor(l *lua.State) int {
-	v := math.Floor(l.ToFloat(1))
+	v := math.Floor(l.CheckNumber(1))
 	x := int64(v)
 	if float64(x) == v {
 		l.Push(x)
@@ -221,16 +224,29 @@ func lfloor(l *lua.State) int {
 }
 
 func lfmod(l *lua.State) int {
-	x := l.ToFloat(1)
-	y := l.ToFloat(2)
+	if l.STypeOf(1) == lua.STypeInteger && l.STypeOf(2) == lua.STypeInteger {
+		// The result of the integer fmod has the sign of x, unlike the % operator.
+		x, y := l.ToInteger(1), l.ToInteger(2)
+		switch y {
+		case 0:
+			l.ArgError(2, "zero")
+		case -1:
+			l.Push(int64(0))
+		default:
+			l.Push(x % y)
+		}
+		return 1
+	}
+	x := l.CheckNumber(1)
+	y := l.CheckNumber(2)
 	l.Push(math.Mod(x, y))
 	return 1
 }
 
 func llog(l *lua.State) int {
-	v := math.Log(l.ToFloat(1))
+	v := math.Log(l.CheckNumber(1))
 	if !l.IsNil(2) {
-		v = v / math.Log(l.ToFloat(2))
+		v = v / math.Log(l.CheckNumber(2))
 	}
 	l.Push(v)
 	return 1
@@ -238,7 +254,9 @@ func llog(l *lua.State) int {
 
 func lmax(l *lua.State) int {
 	n, m := l.AbsIndex(-1), 1
+	l.CheckNumber(1)
 	for i := 1; i <= n; i++ {
+		l.CheckNumber(i)
 		if l.Compare(m, i, lua.OpLessThan) {
 			m = i
 		}
@@ -249,7 +267,9 @@ func lmax(l *lua.State) int {
 
 func lmin(l *lua.State) int {
 	n, m := l.AbsIndex(-1), 1
+	l.CheckNumber(1)
 	for i := 1; i <= n; i++ {
+		l.CheckNumber(i)
 		if l.Compare(i, m, lua.OpLessThan) {
 			m = i
 		}
@@ -259,7 +279,7 @@ func lmin(l *lua.State) int {
 }
 
 func lmodf(l *lua.State) int {
-	a, b := math.Modf(l.ToFloat(1))
+	a, b := math.Modf(l.CheckNumber(1))
 	x := int64(a)
 	if float64(x) == a {
 		l.Push(x)
@@ -271,45 +291,61 @@ func lmodf(l *lua.State) int {
 }
 
 func lrad(l *lua.State) int {
-	l.Push(math.Pi * l.ToFloat(1) / 180)
+	l.Push(math.Pi * l.CheckNumber(1) / 180)
 	return 1
 }
 
 func lrandom(l *lua.State) int {
+	rmu.Lock()
+	defer rmu.Unlock()
 	switch l.AbsIndex(-1) {
 	case 0:
-		l.Push(rand.Float64())
+		l.Push(rnd.Float64())
 	case 1:
-		l.Push(rand.Int63n(l.ToInteger(1)) + 1)
+		n := l.CheckInteger(1)
+		if n < 1 {
+			l.ArgError(1, "interval is empty")
+		}
+		l.Push(rnd.Int63n(n) + 1)
+	case 2:
+		m := l.CheckInteger(1)
+		n := l.CheckInteger(2)
+		if m > n {
+			l.ArgError(2, "interval is empty")
+		} else if n-m+1 <= 0 {
+			l.ArgError(1, "interval too large")
+		}
+		l.Push(rnd.Int63n(n-m+1) + m)
 	default:
-		m := l.ToInteger(1)
-		n := l.ToInteger(2)
-		l.Push(rand.Int63n(n-m+1) + m)
+		panic("wrong number of arguments")
 	}
 	return 1
 }
 
 func lrandomseed(l *lua.State) int {
-	rand.Seed(l.ToInteger(1))
+	rmu.Lock()
+	defer rmu.Unlock()
+	rnd.Seed(int64(l.CheckNumber(1)))
 	return 0
 }
 
 func lsin(l *lua.State) int {
-	l.Push(math.Sin(l.ToFloat(1)))
+	l.Push(math.Sin(l.CheckNumber(1)))
 	return 1
 }
 
 func lsqrt(l *lua.State) int {
-	l.Push(math.Sqrt(l.ToFloat(1)))
+	l.Push(math.Sqrt(l.CheckNumber(1)))
 	return 1
 }
 
 func ltan(l *lua.State) int {
-	l.Push(math.Tan(l.ToFloat(1)))
+	l.Push(math.Tan(l.CheckNumber(1)))
 	return 1
 }
 
 func ltointeger(l *lua.State) int {
+	l.CheckAny(1)
 	if v, err := l.TryInteger(1); err == nil {
 		l.Push(v)
 	} else {
@@ -319,6 +355,7 @@ func ltointeger(l *lua.State) int {
 }
 
 func ltype(l *lua.State) int {
+	l.CheckAny(1)
 	if t := l.STypeOf(1); t == lua.STypeUnknown {
 		l.Push(nil)
 	} else {
@@ -328,8 +365,8 @@ func ltype(l *lua.State) int {
 }
 
 func lult(l *lua.State) int {
-	x := l.ToInteger(1)
-	y := l.ToInteger(2)
+	x := l.CheckInteger(1)
+	y := l.CheckInteger(2)
 	l.Push(uint64(x) < uint64(y))
 	return 1
 }
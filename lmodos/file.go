@@ -28,27 +28,17 @@ import (
 	"github.com/ofunc/lua"
 )
 
-func matefile(l *lua.State) int {
-	l.NewTable(0, 2)
-	idx := l.AbsIndex(-1)
-
-	l.Push("__index")
-	l.PushIndex(idx)
-	l.SetTableRaw(idx)
-
-	l.Push("close")
-	l.Push(lclose)
-	l.SetTableRaw(idx)
-
-	l.Push("seek")
-	l.Push(lseek)
-	l.SetTableRaw(idx)
-
-	return idx
+func registerFile(l *lua.State) {
+	l.RegisterType("os.File", map[string]func(*lua.State) int{
+		"close": lclose,
+		"seek":  lseek,
+	})
 }
 
 func lclose(l *lua.State) int {
-	if err := toFile(l, 1).Close(); err == nil {
+	f := toFile(l, 1)
+	CheckFile(l, f, ReadOnly)
+	if err := f.Close(); err == nil {
 		l.Push(true)
 		return 1
 	} else {
@@ -59,21 +49,11 @@ func lclose(l *lua.State) int {
 }
 
 func lseek(l *lua.State) int {
-	whence := os.SEEK_CUR
-	switch name := l.OptString(2, "cur"); name {
-	case "set":
-		whence = os.SEEK_SET
-	case "cur":
-		whence = os.SEEK_CUR
-	case "end":
-		whence = os.SEEK_END
-	default:
-		l.Push(nil)
-		l.Push("invalid whence: " + name)
-		return 2
-	}
+	whence := []int{os.SEEK_SET, os.SEEK_CUR, os.SEEK_END}[l.CheckOption(2, "cur", []string{"set", "cur", "end"})]
 	offset := l.OptInteger(3, 0)
-	if ret, err := toFile(l, 1).Seek(offset, whence); err == nil {
+	f := toFile(l, 1)
+	CheckFile(l, f, ReadOnly)
+	if ret, err := f.Seek(offset, whence); err == nil {
 		l.Push(ret)
 		return 1
 	} else {
@@ -84,10 +64,5 @@ func lseek(l *lua.State) int {
 }
 
 func toFile(l *lua.State, i int) *os.File {
-	if f, ok := l.GetRaw(1).(*os.File); ok {
-		return f
-	} else {
-		panic("not a file: " + l.ToString(i))
-		return nil
-	}
+	return l.CheckUserData(i, "os.File").(*os.File)
 }
@@ -28,30 +28,25 @@ import (
 	"github.com/ofunc/lua"
 )
 
-func metainfo(l *lua.State) int {
-	l.NewTable(0, 2)
-	idx := l.AbsIndex(-1)
-
-	l.Push("__index")
-	l.Push(func(l *lua.State) int {
-		info, ok := l.GetRaw(1).(os.FileInfo)
-		if !ok {
-			panic("not a fileinfo: " + l.ToString(1))
-		}
-		switch l.ToString(2) {
-		case "name":
-			l.Push(info.Name())
-		case "isdir":
-			l.Push(info.IsDir())
-		case "size":
-			l.Push(info.Size())
-		case "modtime":
-			l.Push(info.ModTime())
-		default:
-			l.Push(nil)
-		}
-		return 1
+func registerInfo(l *lua.State) {
+	l.RegisterType("os.FileInfo", map[string]func(*lua.State) int{
+		"__index": linfo,
 	})
-	l.SetTableRaw(idx)
-	return idx
+}
+
+func linfo(l *lua.State) int {
+	info := l.CheckUserData(1, "os.FileInfo").(os.FileInfo)
+	switch l.ToString(2) {
+	case "name":
+		l.Push(info.Name())
+	case "isdir":
+		l.Push(info.IsDir())
+	case "size":
+		l.Push(info.Size())
+	case "modtime":
+		l.PushUserData(info.ModTime(), "os.Time")
+	default:
+		l.Push(nil)
+	}
+	return 1
 }
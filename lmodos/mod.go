@@ -34,16 +34,19 @@ import (
 	"github.com/ofunc/lua"
 )
 
-// The root path for the executable.
+// The root path for the executable, the os.root of the States without Options.Root.
+//
+// Deprecated: Use SetOptions to set the root of a State.
 var Root string
 
 var start = time.Now()
 
 // Open opens the module.
 func Open(l *lua.State) int {
-	minfo := metainfo(l)
-	mfile := matefile(l)
-	mprog := mateprog(l)
+	registerFile(l)
+	registerInfo(l)
+	registerProg(l)
+	l.RegisterType("os.Time", nil)
 	l.NewTable(0, 32)
 
 	l.Push("abs")
@@ -83,11 +86,11 @@ func Open(l *lua.State) int {
 	l.SetTableRaw(-3)
 
 	l.Push("open")
-	l.PushClosure(lopen, mfile)
+	l.Push(lopen)
 	l.SetTableRaw(-3)
 
 	l.Push("popen")
-	l.PushClosure(lpopen, mprog)
+	l.Push(lpopen)
 	l.SetTableRaw(-3)
 
 	l.Push("remove")
@@ -99,7 +102,7 @@ func Open(l *lua.State) int {
 	l.SetTableRaw(-3)
 
 	l.Push("root")
-	l.Push(Root)
+	l.Push(GetOptions(l).Root)
 	l.SetTableRaw(-3)
 
 	l.Push("setlocale")
@@ -111,7 +114,7 @@ func Open(l *lua.State) int {
 	l.SetTableRaw(-3)
 
 	l.Push("stat")
-	l.PushClosure(lstat, minfo)
+	l.Push(lstat)
 	l.SetTableRaw(-3)
 
 	l.Push("time")
@@ -119,7 +122,7 @@ func Open(l *lua.State) int {
 	l.SetTableRaw(-3)
 
 	l.Push("tmpfile")
-	l.PushClosure(ltmpfile, mfile)
+	l.Push(ltmpfile)
 	l.SetTableRaw(-3)
 
 	l.Push("tmpname")
@@ -127,14 +130,14 @@ func Open(l *lua.State) int {
 	l.SetTableRaw(-3)
 
 	l.Push("walk")
-	l.PushClosure(lwalk, minfo)
+	l.Push(lwalk)
 	l.SetTableRaw(-3)
 
 	return 1
 }
 
 func labs(l *lua.State) int {
-	if p, err := filepath.Abs(l.ToString(1)); err == nil {
+	if p, err := filepath.Abs(l.CheckString(1)); err == nil {
 		l.Push(p)
 		return 1
 	} else {
@@ -148,7 +151,7 @@ func ldate(l *lua.State) int {
 	f := l.OptString(1, "%c")
 	t := time.Now()
 	if !l.IsNil(2) {
-		t = l.GetRaw(2).(time.Time)
+		t = l.CheckUserData(2, "os.Time").(time.Time)
 	}
 
 	if strings.HasPrefix(f, "!") {
@@ -197,13 +200,14 @@ func ldate(l *lua.State) int {
 }
 
 func ldifftime(l *lua.State) int {
-	x := l.GetRaw(1).(time.Time)
-	y := l.GetRaw(2).(time.Time)
+	x := l.CheckUserData(1, "os.Time").(time.Time)
+	y := l.CheckUserData(2, "os.Time").(time.Time)
 	l.Push(float64(x.Sub(y)) / float64(time.Second))
 	return 1
 }
 
 func lexecute(l *lua.State) int {
+	checkExec(l)
 	n := l.AbsIndex(-1)
 	if n < 1 {
 		l.Push(true)
@@ -212,7 +216,7 @@ func lexecute(l *lua.State) int {
 
 	args := make([]string, 0, n)
 	for i := 1; i <= n; i++ {
-		args = append(args, l.ToString(i))
+		args = append(args, l.CheckString(i))
 	}
 	cmd := exec.Command(args[0], args[1:]...)
 	err := cmd.Run()
@@ -227,7 +231,8 @@ func lexecute(l *lua.State) int {
 }
 
 func lexists(l *lua.State) int {
-	if _, err := os.Stat(l.ToString(1)); err == nil {
+	CheckAccess(l, ReadOnly)
+	if _, err := os.Stat(l.CheckString(1)); err == nil {
 		l.Push(true)
 		return 1
 	} else if os.IsNotExist(err) {
@@ -241,6 +246,7 @@ func lexists(l *lua.State) int {
 }
 
 func lexit(l *lua.State) int {
+	checkExit(l)
 	if l.TypeOf(1) == lua.TypeNumber {
 		os.Exit(int(l.ToInteger(1)))
 	} else if l.IsNil(1) || l.ToBoolean(1) {
@@ -252,7 +258,9 @@ func lexit(l *lua.State) int {
 }
 
 func lgetenv(l *lua.State) int {
-	if v := os.Getenv(l.ToString(1)); v == "" {
+	name := l.CheckString(1)
+	checkEnv(l, name)
+	if v := os.Getenv(name); v == "" {
 		l.Push(nil)
 	} else {
 		l.Push(v)
@@ -264,18 +272,19 @@ func ljoin(l *lua.State) int {
 	n := l.AbsIndex(-1)
 	xs := make([]string, 0, n)
 	for i := 1; i <= n; i++ {
-		xs = append(xs, l.ToString(i))
+		xs = append(xs, l.CheckString(i))
 	}
 	l.Push(filepath.Join(xs...))
 	return 1
 }
 
 func lmkdir(l *lua.State) int {
+	CheckAccess(l, ReadWrite)
 	mk := os.Mkdir
 	if l.ToBoolean(2) {
 		mk = os.MkdirAll
 	}
-	if err := mk(l.ToString(1), os.ModeDir); err == nil {
+	if err := mk(l.CheckString(1), os.ModeDir); err == nil {
 		l.Push(true)
 		return 1
 	} else {
@@ -305,14 +314,15 @@ func lopen(l *lua.State) int {
 	case "a+":
 		flag = os.O_RDWR | os.O_CREATE | os.O_TRUNC
 	default:
-		l.Push(nil)
-		l.Push("os.open: unknown mode: " + mode)
-		return 2
+		l.ArgError(2, "invalid mode '"+l.ToString(2)+"'")
 	}
-	if f, err := os.OpenFile(l.ToString(1), flag, 0666); err == nil {
-		l.Push(f)
-		l.PushIndex(lua.FirstUpVal - 1)
-		l.SetMetaTable(-2)
+	if mode == "r" {
+		CheckAccess(l, ReadOnly)
+	} else {
+		CheckAccess(l, ReadWrite)
+	}
+	if f, err := os.OpenFile(l.CheckString(1), flag, 0666); err == nil {
+		l.PushUserData(f, "os.File")
 		return 1
 	} else {
 		l.Push(nil)
@@ -322,12 +332,13 @@ func lopen(l *lua.State) int {
 }
 
 func lpopen(l *lua.State) int {
+	checkExec(l)
 	n := l.AbsIndex(-1)
-	name := l.ToString(1)
+	name := l.CheckString(1)
 	mode := l.OptString(2, "r")
 	args := make([]string, 0, n-1)
 	for i := 3; i <= n; i++ {
-		args = append(args, l.ToString(i))
+		args = append(args, l.CheckString(i))
 	}
 
 	p := prog{}
@@ -337,9 +348,7 @@ func lpopen(l *lua.State) int {
 	case "r":
 		if r, err := p.cmd.StdoutPipe(); err == nil {
 			p.r = r
-			l.Push(p)
-			l.PushIndex(lua.FirstUpVal - 1)
-			l.SetMetaTable(-2)
+			l.PushUserData(p, "os.Prog")
 			l.Push(nil)
 		} else {
 			ok = false
@@ -349,9 +358,7 @@ func lpopen(l *lua.State) int {
 	case "w":
 		if w, err := p.cmd.StdinPipe(); err == nil {
 			p.w = w
-			l.Push(p)
-			l.PushIndex(lua.FirstUpVal - 1)
-			l.SetMetaTable(-2)
+			l.PushUserData(p, "os.Prog")
 			l.Push(nil)
 		} else {
 			ok = false
@@ -359,9 +366,7 @@ func lpopen(l *lua.State) int {
 			l.Push(err.Error())
 		}
 	default:
-		ok = false
-		l.Push(nil)
-		l.Push("unknown popen mode: " + mode)
+		l.ArgError(2, "invalid mode '"+mode+"'")
 	}
 	if ok {
 		if err := p.cmd.Start(); err != nil {
@@ -373,11 +378,12 @@ func lpopen(l *lua.State) int {
 }
 
 func lremove(l *lua.State) int {
+	CheckAccess(l, ReadWrite)
 	rm := os.Remove
 	if l.ToBoolean(2) {
 		rm = os.RemoveAll
 	}
-	if err := rm(l.ToString(1)); err == nil {
+	if err := rm(l.CheckString(1)); err == nil {
 		l.Push(true)
 		return 1
 	} else {
@@ -388,8 +394,9 @@ func lremove(l *lua.State) int {
 }
 
 func lrename(l *lua.State) int {
-	old := l.ToString(1)
-	new := l.ToString(2)
+	CheckAccess(l, ReadWrite)
+	old := l.CheckString(1)
+	new := l.CheckString(2)
 	if err := os.Rename(old, new); err == nil {
 		l.Push(true)
 		return 1
@@ -405,30 +412,32 @@ func lsetlocale(l *lua.State) int {
 }
 
 func lsleep(l *lua.State) int {
-	time.Sleep(time.Duration(l.ToInteger(1)) * time.Millisecond)
-	return 0
+	t := time.NewTimer(time.Duration(l.CheckInteger(1)) * time.Millisecond)
+	defer t.Stop()
+	ctx := l.Context()
+	select {
+	case <-t.C:
+		return 0
+	case <-ctx.Done():
+		panic(ctx.Err())
+	}
 }
 
 func lstat(l *lua.State) int {
 	var info os.FileInfo
 	var err error
-	switch l.TypeOf(1) {
-	case lua.TypeString:
-		info, err = os.Stat(l.ToString(1))
-	case lua.TypeUserData:
-		if f, ok := l.GetRaw(1).(*os.File); ok {
-			info, err = f.Stat()
-		} else {
-			panic("not string or fileinfo: " + l.ToString(1))
-		}
-	default:
-		panic("not string or fileinfo: " + l.ToString(1))
+	if f, ok := l.TestUserData(1, "os.File"); ok {
+		CheckFile(l, f, ReadOnly)
+		info, err = f.(*os.File).Stat()
+	} else if l.TypeOf(1) == lua.TypeString {
+		CheckAccess(l, ReadOnly)
+		info, err = os.Stat(l.CheckString(1))
+	} else {
+		l.TypeError(1, "string or os.File")
 	}
 
 	if err == nil {
-		l.Push(info)
-		l.PushIndex(lua.FirstUpVal - 1)
-		l.SetMetaTable(-2)
+		l.PushUserData(info, "os.FileInfo")
 		return 1
 	} else {
 		l.Push(nil)
@@ -439,42 +448,42 @@ func lstat(l *lua.State) int {
 
 func ltime(l *lua.State) int {
 	if l.IsNil(1) {
-		l.Push(time.Now())
+		l.PushUserData(time.Now(), "os.Time")
 	} else {
-		l.Push("year")
-		l.GetTable(1)
-		year := int(l.ToInteger(-1))
-
-		l.Push("month")
-		l.GetTable(1)
-		month := time.Month(l.ToInteger(-1))
-
-		l.Push("day")
-		l.GetTable(1)
-		day := int(l.ToInteger(-1))
-
-		l.Push("hour")
-		l.GetTable(1)
-		hour := int(l.OptInteger(-1, 12))
-
-		l.Push("min")
-		l.GetTable(1)
-		min := int(l.OptInteger(-1, 0))
-
-		l.Push("sec")
-		l.GetTable(1)
-		sec := int(l.OptInteger(-1, 0))
-
-		l.Push(time.Date(year, month, day, hour, min, sec, 0, time.Local))
+		l.CheckTable(1)
+		year := getfield(l, "year", -1)
+		month := time.Month(getfield(l, "month", -1))
+		day := getfield(l, "day", -1)
+		hour := getfield(l, "hour", 12)
+		min := getfield(l, "min", 0)
+		sec := getfield(l, "sec", 0)
+		l.PushUserData(time.Date(year, month, day, hour, min, sec, 0, time.Local), "os.Time")
 	}
 	return 1
 }
 
+// getfield reads the integer field k of the table at index 1, or d if the field is nil and d is not negative.
+func getfield(l *lua.State, k string, d int64) int {
+	l.Push(k)
+	l.GetTable(1)
+	defer l.Pop(1)
+	if l.IsNil(-1) {
+		if d < 0 {
+			panic("field '" + k + "' missing in date table")
+		}
+		return int(d)
+	}
+	v, err := l.TryInteger(-1)
+	if err != nil {
+		panic("field '" + k + "' is not an integer")
+	}
+	return int(v)
+}
+
 func ltmpfile(l *lua.State) int {
+	CheckAccess(l, ReadWrite)
 	if f, err := ioutil.TempFile("", ""); err == nil {
-		l.Push(f)
-		l.PushIndex(lua.FirstUpVal - 1)
-		l.SetMetaTable(-2)
+		l.PushUserData(f, "os.File")
 		return 1
 	} else {
 		l.Push(nil)
@@ -484,6 +493,7 @@ func ltmpfile(l *lua.State) int {
 }
 
 func ltmpname(l *lua.State) int {
+	CheckAccess(l, ReadWrite)
 	f, err := ioutil.TempFile("", "")
 	if err != nil {
 		return 0
@@ -496,12 +506,15 @@ func ltmpname(l *lua.State) int {
 }
 
 func lwalk(l *lua.State) int {
-	err := filepath.Walk(l.ToString(1), func(path string, info os.FileInfo, err error) error {
+	CheckAccess(l, ReadOnly)
+	err := filepath.Walk(l.CheckString(1), func(path string, info os.FileInfo, err error) error {
 		l.PushIndex(2)
 		l.Push(path)
-		l.Push(info)
-		l.PushIndex(lua.FirstUpVal - 1)
-		l.SetMetaTable(-2)
+		if info == nil {
+			l.Push(nil)
+		} else {
+			l.PushUserData(info, "os.FileInfo")
+		}
 		if err == nil {
 			l.Push(nil)
 		} else {
@@ -0,0 +1,107 @@
+/*
+Copyright 2019 by ofunc
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lmodos
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/ofunc/lua"
+)
+
+// Options is the settings of the os and io modules of a State, see SetOptions.
+type Options struct {
+	Root   string    // The value of os.root, the directory of the executable if it is empty
+	Stdin  io.Reader // The standard files of the io module, the ones of the process if they are nil
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// SetOptions sets the options of the os and io modules of the State l.
+// The os module must not have been opened yet for the root to take effect.
+func SetOptions(l *lua.State, o Options) {
+	l.Push("_OSOPTIONS")
+	l.Push(&o)
+	l.SetTableRaw(lua.RegistryIndex)
+}
+
+// GetOptions returns the options of the State l, with the defaults for the settings that are not set.
+func GetOptions(l *lua.State) Options {
+	o := *getOptions(l)
+	if o.Root == "" {
+		o.Root = Root
+	}
+	if o.Stdin == nil {
+		o.Stdin = os.Stdin
+	}
+	if o.Stdout == nil {
+		o.Stdout = os.Stdout
+	}
+	if o.Stderr == nil {
+		o.Stderr = os.Stderr
+	}
+	return o
+}
+
+// getOptions returns the options of the State l, they are created if there are none.
+func getOptions(l *lua.State) *Options {
+	l.Push("_OSOPTIONS")
+	l.GetTableRaw(lua.RegistryIndex)
+	o, ok := l.GetRaw(-1).(*Options)
+	l.Pop(1)
+	if !ok {
+		o = &Options{}
+		l.Push("_OSOPTIONS")
+		l.Push(o)
+		l.SetTableRaw(lua.RegistryIndex)
+	}
+	return o
+}
+
+// SetStdio replaces the standard file name, "stdin", "stdout" or "stderr", of the State l with f.
+// f must be an io.Reader for stdin, or an io.Writer otherwise, an error is returned if it isn't.
+func SetStdio(l *lua.State, name string, f interface{}) error {
+	o := getOptions(l)
+	switch name {
+	case "stdin":
+		r, ok := f.(io.Reader)
+		if !ok {
+			return errors.New("stdin must be an io.Reader")
+		}
+		o.Stdin = r
+	case "stdout", "stderr":
+		w, ok := f.(io.Writer)
+		if !ok {
+			return errors.New(name + " must be an io.Writer")
+		}
+		if name == "stdout" {
+			o.Stdout = w
+		} else {
+			o.Stderr = w
+		}
+	default:
+		return errors.New("invalid standard file: " + name)
+	}
+	return nil
+}
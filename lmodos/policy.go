@@ -0,0 +1,137 @@
+/*
+Copyright 2019 by ofunc
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lmodos
+
+import (
+	"os"
+
+	"github.com/ofunc/lua"
+)
+
+// Access is the access to the file system.
+type Access int
+
+const (
+	NoAccess  Access = iota // Files can't be used
+	ReadOnly                // Files and directories can be read
+	ReadWrite               // Files and directories can also be created, modified and removed
+)
+
+// Policy is what the scripts of a State may do through the os and io modules, see SetPolicy.
+// The zero value allows nothing.
+type Policy struct {
+	Files Access   // The access to the file system
+	Exec  bool     // Can programs be run, by os.execute and os.popen
+	Exit  bool     // Can the process be terminated, by os.exit
+	Stdio bool     // Can the standard files be replaced
+	Env   []string // The environment variables that os.getenv can read, "*" for all of them
+}
+
+// Unrestricted allows everything, it is the policy of a State without SetPolicy.
+var Unrestricted = Policy{
+	Files: ReadWrite,
+	Exec:  true,
+	Exit:  true,
+	Stdio: true,
+	Env:   []string{"*"},
+}
+
+// SetPolicy restricts the os and io modules of the State l and its coroutines and threads to the policy p.
+// It is checked each time a function is called or a handle is used (see CheckFile), so it also covers
+// the functions and handles that scripts kept from before, or got from the host.
+func SetPolicy(l *lua.State, p Policy) {
+	p.Env = append([]string(nil), p.Env...)
+	l.Push("_OSPOLICY")
+	l.Push(&p)
+	l.SetTableRaw(lua.RegistryIndex)
+}
+
+// GetPolicy returns the policy of the State l.
+func GetPolicy(l *lua.State) Policy {
+	return *getPolicy(l)
+}
+
+func getPolicy(l *lua.State) *Policy {
+	l.Push("_OSPOLICY")
+	l.GetTableRaw(lua.RegistryIndex)
+	p, ok := l.GetRaw(-1).(*Policy)
+	l.Pop(1)
+	if !ok {
+		return &Unrestricted
+	}
+	return p
+}
+
+// CheckAccess raises an error if the policy of the State l doesn't give the access a to the file system.
+func CheckAccess(l *lua.State, a Access) {
+	if getPolicy(l).Files < a {
+		if a == ReadOnly {
+			panic("permission denied: read files")
+		}
+		panic("permission denied: write files")
+	}
+}
+
+// CheckFile raises an error if the policy of the State l doesn't allow using the handle f with the access a.
+// Files, other than the standard files of l, need the access a to the file system, and the programs
+// started by os.popen need Exec. Other values are always allowed. Handles are checked each time they are used,
+// so the ones opened before SetPolicy or got from the host are covered.
+func CheckFile(l *lua.State, f interface{}, a Access) {
+	switch x := f.(type) {
+	case *os.File:
+		o := GetOptions(l)
+		if x != o.Stdin && x != o.Stdout && x != o.Stderr {
+			CheckAccess(l, a)
+		}
+	case prog:
+		checkExec(l)
+	}
+}
+
+// CheckStdio raises an error if the policy of the State l doesn't allow replacing the standard files.
+func CheckStdio(l *lua.State) {
+	if !getPolicy(l).Stdio {
+		panic("permission denied: replace standard files")
+	}
+}
+
+func checkExec(l *lua.State) {
+	if !getPolicy(l).Exec {
+		panic("permission denied: run programs")
+	}
+}
+
+func checkExit(l *lua.State) {
+	if !getPolicy(l).Exit {
+		panic("permission denied: exit")
+	}
+}
+
+func checkEnv(l *lua.State, name string) {
+	for _, x := range getPolicy(l).Env {
+		if x == "*" || x == name {
+			return
+		}
+	}
+	panic("permission denied: read environment variable '" + name + "'")
+}
@@ -24,7 +24,9 @@ package lmodos
 
 import (
 	"io"
+	"os"
 	"os/exec"
+	"time"
 
 	"github.com/ofunc/lua"
 )
@@ -45,6 +47,14 @@ func (p prog) Write(xs []byte) (int, error) {
 	return p.w.Write(xs)
 }
 
+// SetReadDeadline sets the deadline for future Read calls, if the output of the prog supports it.
+func (p prog) SetReadDeadline(t time.Time) error {
+	if d, ok := p.r.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	return os.ErrNoDeadline
+}
+
 //Close closes the prog, rendering it unusable for I/O.
 func (p prog) Close() (err error) {
 	err = p.cmd.Process.Kill()
@@ -63,33 +73,19 @@ func (p prog) Close() (err error) {
 	return
 }
 
-func mateprog(l *lua.State) int {
-	l.NewTable(0, 2)
-	idx := l.AbsIndex(-1)
-
-	l.Push("__index")
-	l.PushIndex(idx)
-	l.SetTableRaw(idx)
-
-	l.Push("close")
-	l.Push(lpclose)
-	l.SetTableRaw(idx)
-
-	return idx
+func registerProg(l *lua.State) {
+	l.RegisterType("os.Prog", map[string]func(*lua.State) int{
+		"close": lpclose,
+	})
 }
 
 func lpclose(l *lua.State) int {
-	if c, ok := l.GetRaw(1).(io.Closer); ok {
-		if err := c.Close(); err == nil {
-			l.Push(true)
-			return 1
-		} else {
-			l.Push(nil)
-			l.Push(err.Error())
-			return 2
-		}
+	if err := l.CheckUserData(1, "os.Prog").(prog).Close(); err == nil {
+		l.Push(true)
+		return 1
 	} else {
-		panic("os.prog: not a prog")
-		return 0
+		l.Push(nil)
+		l.Push(err.Error())
+		return 2
 	}
 }
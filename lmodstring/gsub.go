@@ -32,7 +32,7 @@ import (
 )
 
 func gsubstr(l *lua.State, str string, matches []*pm.MatchData) string {
-	repl := l.OptString(3, "")
+	repl := l.CheckString(3)
 	infoList := make([]replaceInfo, 0, len(matches))
 	for _, match := range matches {
 		start, end := match.Capture(0), match.Capture(1)
@@ -24,6 +24,8 @@ package lmodstring
 
 import (
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
 
 	"github.com/ofunc/lua"
@@ -70,6 +72,14 @@ func Open(l *lua.State) int {
 	l.Push(lmatch)
 	l.SetTableRaw(-3)
 
+	l.Push("pack")
+	l.Push(lpack)
+	l.SetTableRaw(-3)
+
+	l.Push("packsize")
+	l.Push(lpacksize)
+	l.SetTableRaw(-3)
+
 	l.Push("rep")
 	l.Push(lrep)
 	l.SetTableRaw(-3)
@@ -82,6 +92,10 @@ func Open(l *lua.State) int {
 	l.Push(lsub)
 	l.SetTableRaw(-3)
 
+	l.Push("unpack")
+	l.Push(lunpack)
+	l.SetTableRaw(-3)
+
 	l.Push("upper")
 	l.Push(lupper)
 	l.SetTableRaw(-3)
@@ -98,7 +112,7 @@ func Open(l *lua.State) int {
 }
 
 func lbyte(l *lua.State) int {
-	s := l.OptString(1, "")
+	s := l.CheckString(1)
 	n := len(s)
 	i := int(l.OptInteger(2, 1))
 	j := int(l.OptInteger(3, int64(i)))
@@ -127,16 +141,20 @@ func lchar(l *lua.State) int {
 	n := l.AbsIndex(-1)
 	xs := make([]byte, 0, n)
 	for i := 1; i <= n; i++ {
-		xs = append(xs, byte(l.ToInteger(i)))
+		c := l.CheckInteger(i)
+		if c < 0 || c > 255 {
+			l.ArgError(i, "value out of range")
+		}
+		xs = append(xs, byte(c))
 	}
 	l.Push(string(xs))
 	return 1
 }
 
 func lfind(l *lua.State) int {
-	s := l.OptString(1, "")
+	s := l.CheckString(1)
 	n := len(s)
-	pattern := l.OptString(2, "")
+	pattern := l.CheckString(2)
 	init := int(l.OptInteger(3, 1))
 	if init < 0 {
 		init = n + init + 1
@@ -184,13 +202,121 @@ func lformat(l *lua.State) int {
 	for i := 2; i <= n; i++ {
 		xs = append(xs, l.GetRaw(i))
 	}
-	l.Push(fmt.Sprintf(l.OptString(1, ""), xs...))
+	l.Push(fmt.Sprintf(formatHex(l.CheckString(1), xs), xs...))
 	return 1
 }
 
+// formatHex replaces the %a and %A verbs, which Go doesn't have, by %s and formats their arguments in xs.
+// Verbs with a width or precision given by an argument are left alone.
+func formatHex(format string, xs []interface{}) string {
+	if !strings.ContainsAny(format, "aA") {
+		return format
+	}
+
+	var b strings.Builder
+	k := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			b.WriteByte(format[i])
+			continue
+		}
+		j := i + 1
+		for j < len(format) && strings.IndexByte("+- #0", format[j]) >= 0 {
+			j++
+		}
+		flags := format[i+1 : j]
+		w := j
+		for j < len(format) && (format[j] >= '0' && format[j] <= '9' || format[j] == '.' || format[j] == '*') {
+			if format[j] == '*' {
+				k++
+			}
+			j++
+		}
+		spec := format[w:j]
+		if j == len(format) {
+			b.WriteString(format[i:])
+			break
+		}
+
+		verb := format[j]
+		if verb == '%' {
+			b.WriteString(format[i : j+1])
+		} else if (verb == 'a' || verb == 'A') && k < len(xs) && !strings.Contains(spec, "*") {
+			f, ok := xs[k].(float64)
+			if x, isInt := xs[k].(int64); isInt {
+				f, ok = float64(x), true
+			}
+			if ok {
+				xs[k] = hexFloat(f, flags, spec, verb == 'A')
+				b.WriteString("%s")
+			} else {
+				b.WriteString(format[i : j+1])
+			}
+			k++
+		} else {
+			b.WriteString(format[i : j+1])
+			k++
+		}
+		i = j
+	}
+	return b.String()
+}
+
+// hexFloat formats f like the %a verb of C, for example 0x1.8p+3.
+func hexFloat(f float64, flags, spec string, upper bool) string {
+	prec := -1
+	width, p, hasPrec := strings.Cut(spec, ".")
+	if hasPrec {
+		prec, _ = strconv.Atoi(p)
+	}
+
+	var s string
+	switch {
+	case math.IsNaN(f):
+		s = "nan"
+	case math.IsInf(f, 0):
+		s = "inf"
+		if f < 0 {
+			s = "-inf"
+		}
+	default:
+		s = strconv.FormatFloat(f, 'x', prec, 64)
+		// Go writes at least two digits in the exponent.
+		e := strings.IndexByte(s, 'p') + 2
+		for len(s)-e > 1 && s[e] == '0' {
+			s = s[:e] + s[e+1:]
+		}
+	}
+
+	sign := ""
+	if s[0] == '-' {
+		sign, s = "-", s[1:]
+	} else if strings.Contains(flags, "+") {
+		sign = "+"
+	} else if strings.Contains(flags, " ") {
+		sign = " "
+	}
+	n, _ := strconv.Atoi(width)
+	if pad := n - len(sign) - len(s); pad > 0 {
+		switch {
+		case strings.Contains(flags, "-"):
+			s += strings.Repeat(" ", pad)
+		case strings.Contains(flags, "0") && strings.HasPrefix(s, "0x"):
+			s = "0x" + strings.Repeat("0", pad) + s[2:]
+		default:
+			sign = strings.Repeat(" ", pad) + sign
+		}
+	}
+	s = sign + s
+	if upper {
+		s = strings.ToUpper(s)
+	}
+	return s
+}
+
 func lgmatch(l *lua.State) int {
-	s := l.OptString(1, "")
-	pattern := l.OptString(2, "")
+	s := l.CheckString(1)
+	pattern := l.CheckString(2)
 	mds, err := pm.Find(pattern, []byte(s), 0, -1)
 	if err != nil {
 		panic(err)
@@ -220,9 +346,14 @@ func lgmatch(l *lua.State) int {
 }
 
 func lgsub(l *lua.State) int {
-	s := l.OptString(1, "")
-	pattern := l.OptString(2, "")
+	s := l.CheckString(1)
+	pattern := l.CheckString(2)
 	limit := int(l.OptInteger(4, -1))
+	switch l.TypeOf(3) {
+	case lua.TypeString, lua.TypeNumber, lua.TypeTable, lua.TypeFunction:
+	default:
+		l.TypeError(3, "string/function/table")
+	}
 	mds, err := pm.Find(pattern, []byte(s), 0, limit)
 	if err != nil {
 		panic(err)
@@ -233,33 +364,31 @@ func lgsub(l *lua.State) int {
 		return 2
 	}
 	switch l.TypeOf(3) {
-	case lua.TypeString:
-		l.Push(gsubstr(l, s, mds))
 	case lua.TypeTable:
 		l.Push(gsubtable(l, s, mds))
 	case lua.TypeFunction:
 		l.Push(gsubfunction(l, s, mds))
 	default:
-		panic("string.gsub: invalid argument #3: " + l.ToString(3))
+		l.Push(gsubstr(l, s, mds))
 	}
 	l.Push(len(mds))
 	return 2
 }
 
 func llen(l *lua.State) int {
-	l.Push(l.Length(1))
+	l.Push(len(l.CheckString(1)))
 	return 1
 }
 
 func llower(l *lua.State) int {
-	l.Push(strings.ToLower(l.OptString(1, "")))
+	l.Push(strings.ToLower(l.CheckString(1)))
 	return 1
 }
 
 func lmatch(l *lua.State) int {
-	s := l.OptString(1, "")
+	s := l.CheckString(1)
 	n := len(s)
-	pattern := l.OptString(2, "")
+	pattern := l.CheckString(2)
 	offset := int(l.OptInteger(3, 1))
 	if offset < 0 {
 		offset = offset + n + 1
@@ -294,22 +423,34 @@ func lmatch(l *lua.State) int {
 }
 
 func lrep(l *lua.State) int {
-	s := l.OptString(1, "")
+	s := l.CheckString(1)
 	sep := l.OptString(3, "")
-	n := int(l.OptInteger(2, 0))
-	if n < 0 {
-		n = 0
+	n := l.CheckInteger(2)
+	size := int64(len(s) + len(sep))
+	if n <= 0 || size == 0 {
+		l.Push("")
+		return 1
 	}
-	xs := make([]string, n)
-	for i := 0; i < n; i++ {
-		xs[i] = s
+	if n > math.MaxInt64/size || size*n-int64(len(sep)) > int64(math.MaxInt) {
+		l.ArgError(2, "resulting string too large")
+	}
+	size = size*n - int64(len(sep))
+	l.Alloc(size)
+
+	var b strings.Builder
+	b.Grow(int(size))
+	for i := int64(0); i < n; i++ {
+		if i > 0 {
+			b.WriteString(sep)
+		}
+		b.WriteString(s)
 	}
-	l.Push(strings.Join(xs, sep))
+	l.Push(b.String())
 	return 1
 }
 
 func lreverse(l *lua.State) int {
-	s := l.OptString(1, "")
+	s := l.CheckString(1)
 	n := len(s)
 	xs := make([]byte, 0, n)
 	for i := n - 1; i >= 0; i-- {
@@ -320,7 +461,7 @@ func lreverse(l *lua.State) int {
 }
 
 func lsub(l *lua.State) int {
-	s := l.OptString(1, "")
+	s := l.CheckString(1)
 	n := len(s)
 	i := int(l.OptInteger(2, 1))
 	j := int(l.OptInteger(3, -1))
@@ -346,6 +487,6 @@ func lsub(l *lua.State) int {
 }
 
 func lupper(l *lua.State) int {
-	l.Push(strings.ToUpper(l.OptString(1, "")))
+	l.Push(strings.ToUpper(l.CheckString(1)))
 	return 1
 }
@@ -0,0 +1,370 @@
+/*
+Copyright 2019 by ofunc
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lmodstring
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/ofunc/lua"
+)
+
+// The sizes of the native types of the reference implementation on 64-bit platforms.
+const (
+	sizeInt     = 4
+	sizeSize    = 8
+	sizeInteger = 8
+	maxIntSize  = 16
+	maxAlign    = 8
+)
+
+var nativeLittle = binary.NativeEndian.Uint16([]byte{1, 0}) == 1
+
+// kOption is the kind of a format option.
+type kOption int
+
+const (
+	kInt       kOption = iota // signed integers
+	kUint                     // unsigned integers
+	kFloat                    // single-precision floats
+	kDouble                   // double-precision floats, also used for lua_Number
+	kChar                     // fixed-length strings
+	kString                   // strings with a length prefix
+	kZstr                     // zero-terminated strings
+	kPadding                  // padding bytes
+	kPaddAlign                // padding for alignment
+	kNop                      // options that only change the state
+)
+
+// packer reads a format string of string.pack, string.unpack or string.packsize.
+type packer struct {
+	l        *lua.State
+	format   string
+	little   bool
+	maxAlign int
+}
+
+func newPacker(l *lua.State) *packer {
+	return &packer{l: l, format: l.CheckString(1), little: nativeLittle, maxAlign: 1}
+}
+
+// num reads an optional size from the format, or returns d.
+func (p *packer) num(d int) int {
+	if p.format == "" || p.format[0] < '0' || p.format[0] > '9' {
+		return d
+	}
+	n := 0
+	for p.format != "" && p.format[0] >= '0' && p.format[0] <= '9' && n <= (math.MaxInt32-9)/10 {
+		n = n*10 + int(p.format[0]-'0')
+		p.format = p.format[1:]
+	}
+	return n
+}
+
+// numLimit reads an optional size of an integer from the format, or returns d.
+func (p *packer) numLimit(d int) int {
+	n := p.num(d)
+	if n > maxIntSize || n <= 0 {
+		panic(fmt.Errorf("integral size (%v) out of limits [1,%v]", n, maxIntSize))
+	}
+	return n
+}
+
+// option reads the next option and returns its kind and size.
+func (p *packer) option() (kOption, int) {
+	c := p.format[0]
+	p.format = p.format[1:]
+	switch c {
+	case 'b':
+		return kInt, 1
+	case 'B':
+		return kUint, 1
+	case 'h':
+		return kInt, 2
+	case 'H':
+		return kUint, 2
+	case 'l', 'j':
+		return kInt, sizeInteger
+	case 'L', 'J':
+		return kUint, sizeInteger
+	case 'T':
+		return kUint, sizeSize
+	case 'f':
+		return kFloat, 4
+	case 'd', 'n':
+		return kDouble, 8
+	case 'i':
+		return kInt, p.numLimit(sizeInt)
+	case 'I':
+		return kUint, p.numLimit(sizeInt)
+	case 's':
+		return kString, p.numLimit(sizeSize)
+	case 'c':
+		n := p.num(-1)
+		if n == -1 {
+			panic(fmt.Errorf("missing size for format option 'c'"))
+		}
+		return kChar, n
+	case 'z':
+		return kZstr, 0
+	case 'x':
+		return kPadding, 1
+	case 'X':
+		return kPaddAlign, 0
+	case ' ':
+	case '<':
+		p.little = true
+	case '>':
+		p.little = false
+	case '=':
+		p.little = nativeLittle
+	case '!':
+		p.maxAlign = p.numLimit(maxAlign)
+	default:
+		panic(fmt.Errorf("invalid format option '%c'", c))
+	}
+	return kNop, 0
+}
+
+// details reads the next option, and returns its kind, its size and the padding needed to align it at offset.
+func (p *packer) details(offset int) (kOption, int, int) {
+	opt, size := p.option()
+	align := size
+	if opt == kPaddAlign {
+		// 'X' takes its alignment from the next option.
+		if p.format == "" {
+			p.l.ArgError(1, "invalid next option for option 'X'")
+		}
+		var next kOption
+		next, align = p.option()
+		if next == kChar || align == 0 {
+			p.l.ArgError(1, "invalid next option for option 'X'")
+		}
+	}
+	if align <= 1 || opt == kChar {
+		return opt, size, 0
+	}
+	if align > p.maxAlign {
+		align = p.maxAlign
+	}
+	if align&(align-1) != 0 {
+		p.l.ArgError(1, "format asks for alignment not power of 2")
+	}
+	return opt, size, (align - offset&(align-1)) & (align - 1)
+}
+
+// packInt appends the size bytes of n, negative numbers are sign extended.
+func (p *packer) packInt(b []byte, n uint64, size int, neg bool) []byte {
+	xs := make([]byte, size)
+	for i := 0; i < size; i++ {
+		x := byte(0)
+		if i < sizeInteger {
+			x = byte(n >> (8 * i))
+		} else if neg {
+			x = 0xff
+		}
+		if p.little {
+			xs[i] = x
+		} else {
+			xs[size-1-i] = x
+		}
+	}
+	return append(b, xs...)
+}
+
+// unpackInt reads an integer of size bytes from xs.
+func (p *packer) unpackInt(xs []byte, size int, signed bool) int64 {
+	at := func(i int) byte {
+		if p.little {
+			return xs[i]
+		}
+		return xs[size-1-i]
+	}
+	limit := size
+	if limit > sizeInteger {
+		limit = sizeInteger
+	}
+	var n uint64
+	for i := limit - 1; i >= 0; i-- {
+		n = n<<8 | uint64(at(i))
+	}
+	if size < sizeInteger {
+		if signed {
+			mask := uint64(1) << (size*8 - 1)
+			n = (n ^ mask) - mask
+		}
+	} else if size > sizeInteger {
+		// The bytes that don't fit must only extend the sign.
+		ext := byte(0)
+		if signed && int64(n) < 0 {
+			ext = 0xff
+		}
+		for i := limit; i < size; i++ {
+			if at(i) != ext {
+				panic(fmt.Errorf("%v-byte integer does not fit into Lua Integer", size))
+			}
+		}
+	}
+	return int64(n)
+}
+
+func lpack(l *lua.State) int {
+	p := newPacker(l)
+	var b []byte
+	arg := 1
+	for p.format != "" {
+		opt, size, pad := p.details(len(b))
+		for ; pad > 0; pad-- {
+			b = append(b, 0)
+		}
+		arg++
+		switch opt {
+		case kInt:
+			n := l.CheckInteger(arg)
+			if size < sizeInteger {
+				lim := int64(1) << (size*8 - 1)
+				if n < -lim || n >= lim {
+					l.ArgError(arg, "integer overflow")
+				}
+			}
+			b = p.packInt(b, uint64(n), size, n < 0)
+		case kUint:
+			n := l.CheckInteger(arg)
+			if size < sizeInteger && uint64(n) >= uint64(1)<<(size*8) {
+				l.ArgError(arg, "unsigned overflow")
+			}
+			b = p.packInt(b, uint64(n), size, false)
+		case kFloat:
+			b = p.packInt(b, uint64(math.Float32bits(float32(l.CheckNumber(arg)))), size, false)
+		case kDouble:
+			b = p.packInt(b, math.Float64bits(l.CheckNumber(arg)), size, false)
+		case kChar:
+			s := l.CheckString(arg)
+			if len(s) > size {
+				l.ArgError(arg, "string longer than given size")
+			}
+			b = append(b, s...)
+			for i := len(s); i < size; i++ {
+				b = append(b, 0)
+			}
+		case kString:
+			s := l.CheckString(arg)
+			if size < sizeSize && uint64(len(s)) >= uint64(1)<<(size*8) {
+				l.ArgError(arg, "string length does not fit in given size")
+			}
+			b = p.packInt(b, uint64(len(s)), size, false)
+			b = append(b, s...)
+		case kZstr:
+			s := l.CheckString(arg)
+			if strings.IndexByte(s, 0) >= 0 {
+				l.ArgError(arg, "string contains zeros")
+			}
+			b = append(b, s...)
+			b = append(b, 0)
+		case kPadding:
+			b = append(b, 0)
+			arg--
+		case kPaddAlign, kNop:
+			arg--
+		}
+	}
+	l.Alloc(int64(len(b)))
+	l.Push(string(b))
+	return 1
+}
+
+func lpacksize(l *lua.State) int {
+	p := newPacker(l)
+	total := 0
+	for p.format != "" {
+		opt, size, pad := p.details(total)
+		if opt == kString || opt == kZstr {
+			l.ArgError(1, "variable-length format")
+		}
+		size += pad
+		if total > math.MaxInt32-size {
+			l.ArgError(1, "format result too large")
+		}
+		total += size
+	}
+	l.Push(total)
+	return 1
+}
+
+func lunpack(l *lua.State) int {
+	p := newPacker(l)
+	data := l.CheckString(2)
+	ld := len(data)
+	pos := l.OptInteger(3, 1)
+	if pos < 0 {
+		if -pos > int64(ld) {
+			pos = 0
+		} else {
+			pos = int64(ld) + pos + 1
+		}
+	}
+	if pos < 1 || pos-1 > int64(ld) {
+		l.ArgError(3, "initial position out of string")
+	}
+
+	i, n := int(pos-1), 0
+	for p.format != "" {
+		opt, size, pad := p.details(i)
+		if pad+size > ld-i {
+			l.ArgError(2, "data string too short")
+		}
+		i += pad
+		n++
+		switch opt {
+		case kInt, kUint:
+			l.Push(p.unpackInt([]byte(data[i:i+size]), size, opt == kInt))
+		case kFloat:
+			l.Push(float64(math.Float32frombits(uint32(p.unpackInt([]byte(data[i:i+size]), size, false)))))
+		case kDouble:
+			l.Push(math.Float64frombits(uint64(p.unpackInt([]byte(data[i:i+size]), size, false))))
+		case kChar:
+			l.Push(data[i : i+size])
+		case kString:
+			m := uint64(p.unpackInt([]byte(data[i:i+size]), size, false))
+			if m > uint64(ld-i-size) {
+				l.ArgError(2, "data string too short")
+			}
+			l.Push(data[i+size : i+size+int(m)])
+			i += int(m)
+		case kZstr:
+			m := strings.IndexByte(data[i:], 0)
+			if m < 0 {
+				l.ArgError(2, "unfinished string for format 'z'")
+			}
+			l.Push(data[i : i+m])
+			i += m + 1
+		default:
+			n--
+		}
+		i += size
+	}
+	l.Push(i + 1)
+	return n + 1
+}
@@ -23,6 +23,7 @@ misrepresented as being the original software.
 package lmodtable
 
 import (
+	"fmt"
 	"sort"
 	"strings"
 
@@ -65,30 +66,44 @@ func Open(l *lua.State) int {
 }
 
 func lconcat(l *lua.State) int {
+	l.CheckTable(1)
 	n := l.Length(1)
 	s := l.OptString(2, "")
 	i := l.OptInteger(3, 1)
 	j := l.OptInteger(4, int64(n))
 
+	size := 0
 	xs := make([]string, 0, n)
 	for k := i; k <= j; k++ {
 		l.Push(k)
-		l.GetTable(1)
+		if t := l.GetTable(1); t != lua.TypeString && t != lua.TypeNumber {
+			panic(fmt.Sprintf("invalid value (at index %v) in table for 'concat'", k))
+		}
 		xs = append(xs, l.ToString(-1))
+		size += len(xs[len(xs)-1]) + len(s)
 		l.Pop(1)
 	}
+	l.Alloc(int64(size))
 	l.Push(strings.Join(xs, s))
 	return 1
 }
 
 func linsert(l *lua.State) int {
+	l.CheckTable(1)
 	n := int64(l.Length(1))
 	p := n + 1
 	v := 2
 
-	if l.AbsIndex(-1) > 2 {
-		p = l.ToInteger(2)
+	switch l.AbsIndex(-1) {
+	case 2:
+	case 3:
+		p = l.CheckInteger(2)
+		if p < 1 || p > n+1 {
+			l.ArgError(2, "position out of bounds")
+		}
 		v = 3
+	default:
+		panic("wrong number of arguments to 'insert'")
 	}
 	for i := n; i >= p; i-- {
 		l.Push(i + 1)
@@ -103,12 +118,15 @@ func linsert(l *lua.State) int {
 }
 
 func lmove(l *lua.State) int {
-	f := l.ToInteger(2)
-	e := l.ToInteger(3)
-	t := l.ToInteger(4)
+	l.CheckTable(1)
+	f := l.CheckInteger(2)
+	e := l.CheckInteger(3)
+	t := l.CheckInteger(4)
 	a := 5
 	if l.IsNil(5) {
 		a = 1
+	} else {
+		l.CheckTable(5)
 	}
 
 	if e >= f {
@@ -149,11 +167,12 @@ func lpack(l *lua.State) int {
 }
 
 func lremove(l *lua.State) int {
+	l.CheckTable(1)
 	n := int64(l.Length(1))
 	p := l.OptInteger(2, n)
 
 	if p != n && (p < 1 || p > n) {
-		panic("index out of range")
+		l.ArgError(2, "position out of bounds")
 	}
 	l.Push(p)
 	l.GetTable(1)
@@ -171,7 +190,11 @@ func lremove(l *lua.State) int {
 }
 
 func lsort(l *lua.State) int {
-	if l.AbsIndex(-1) == 1 {
+	l.CheckTable(1)
+	if !l.IsNil(2) {
+		l.CheckType(2, lua.TypeFunction)
+	} else {
+		l.Pop(l.AbsIndex(-1) - 1)
 		l.Push(func(l *lua.State) int {
 			l.Push(l.Compare(1, 2, lua.OpLessThan))
 			return 1
@@ -64,14 +64,18 @@ func lchar(l *lua.State) int {
 	n := l.AbsIndex(-1)
 	xs := make([]rune, 0, n)
 	for i := 1; i <= n; i++ {
-		xs = append(xs, rune(l.ToInteger(i)))
+		c := l.CheckInteger(i)
+		if c < 0 || c > utf8.MaxRune {
+			l.ArgError(i, "value out of range")
+		}
+		xs = append(xs, rune(c))
 	}
 	l.Push(string(xs))
 	return 1
 }
 
 func lcodes(l *lua.State) int {
-	next := liter(l, l.ToString(1), 1, -1)
+	next := liter(l, l.CheckString(1), 1, -1)
 	l.Push(func(l *lua.State) int {
 		if r, n, k := next(); n <= 0 {
 			return 0
@@ -90,7 +94,7 @@ func lcodes(l *lua.State) int {
 func lcodepoint(l *lua.State) int {
 	i := int(l.OptInteger(2, 1))
 	j := int(l.OptInteger(3, int64(i)))
-	next := liter(l, l.ToString(1), i, j)
+	next := liter(l, l.CheckString(1), i, j)
 	m := 0
 	for {
 		if r, n, k := next(); n <= 0 {
@@ -108,7 +112,7 @@ func lcodepoint(l *lua.State) int {
 func llen(l *lua.State) int {
 	i := int(l.OptInteger(2, 1))
 	j := int(l.OptInteger(3, -1))
-	next := liter(l, l.ToString(1), i, j)
+	next := liter(l, l.CheckString(1), i, j)
 	m := 0
 	for {
 		if r, n, k := next(); n <= 0 {
@@ -126,8 +130,8 @@ func llen(l *lua.State) int {
 }
 
 func loffset(l *lua.State) int {
-	s := l.ToString(1)
-	n := int(l.ToInteger(2))
+	s := l.CheckString(1)
+	n := int(l.CheckInteger(2))
 	d := 0
 	if n >= 0 {
 		d = 1
@@ -1,16 +1,33 @@
 package lua_test
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/ofunc/lua"
+	"github.com/ofunc/lua/lmodbase"
+	"github.com/ofunc/lua/lmodos"
 	"github.com/ofunc/lua/util"
 )
 
 func TestMain(m *testing.M) {
 	seq := 123456
-	l := util.NewState()
+	l := util.NewState(util.Options{Paths: []string{""}})
 	l.Preload("seq", func(l *lua.State) int {
 		l.NewTable(0, 2)
 		l.Push("next")
@@ -22,8 +39,1533 @@ func TestMain(m *testing.M) {
 		l.SetTableRaw(-3)
 		return 1
 	})
-	util.AddPath("")
 	if err := util.Test(l, "test"); err != nil {
 		fmt.Println("error:", err)
 	}
+	os.Exit(m.Run())
+}
+
+func TestCoroutine(t *testing.T) {
+	l := util.NewState()
+	l.Push(func(l *lua.State) int {
+		l.Push(l.ToInteger(1) + 1)
+		if n := l.Yield(1); n != 2 {
+			t.Errorf("Yield: got %v values, want 2", n)
+		}
+		l.Push(l.ToInteger(-2) * l.ToInteger(-1))
+		return 1
+	})
+	l.NewCoroutine()
+
+	l.Push(1)
+	if n, msg := l.Resume(1, 1); msg != nil || n != 1 || l.ToInteger(-1) != 2 {
+		t.Fatalf("Resume: got %v, %v, %v", n, msg, l.ToInteger(-1))
+	}
+	l.Pop(1)
+	if s := l.StatusOf(1); s != lua.ThreadSuspended {
+		t.Fatalf("StatusOf: got %v", s)
+	}
+
+	l.Push(6)
+	l.Push(7)
+	if n, msg := l.Resume(1, 2); msg != nil || n != 1 || l.ToInteger(-1) != 42 {
+		t.Fatalf("Resume: got %v, %v, %v", n, msg, l.ToInteger(-1))
+	}
+	l.Pop(1)
+	if s := l.StatusOf(1); s != lua.ThreadDead {
+		t.Fatalf("StatusOf: got %v", s)
+	}
+	if _, msg := l.Resume(1, 0); msg == nil {
+		t.Fatal("Resume: resumed a dead coroutine")
+	}
+}
+
+func TestCoroutineRelease(t *testing.T) {
+	l := util.NewState()
+	n := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		l.Push(func(l *lua.State) int {
+			return l.Yield(0)
+		})
+		l.NewCoroutine()
+		if _, msg := l.Resume(-1, 0); msg != nil {
+			t.Fatal(msg)
+		}
+		l.Pop(1)
+	}
+	for i := 0; i < 100 && runtime.NumGoroutine() > n; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m := runtime.NumGoroutine(); m > n {
+		t.Fatalf("%v goroutines of suspended coroutines are not released", m-n)
+	}
+
+	// A coroutine that refers to itself is never collected, it must be closed.
+	l.Push(func(l *lua.State) int {
+		l.PushThread()
+		return l.Yield(0)
+	})
+	l.NewCoroutine()
+	if _, msg := l.Resume(-1, 0); msg != nil {
+		t.Fatal(msg)
+	}
+	if err := l.CloseCoroutine(-1); err != nil {
+		t.Fatal(err)
+	}
+	if s := l.StatusOf(-1); s != lua.ThreadDead {
+		t.Fatalf("got %v coroutine after CloseCoroutine", s)
+	}
+	if _, msg := l.Resume(-1, 0); msg == nil {
+		t.Fatal("a closed coroutine must not be resumed")
+	}
+	l.Pop(1)
+	for i := 0; i < 100 && runtime.NumGoroutine() > n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m := runtime.NumGoroutine(); m > n {
+		t.Fatalf("the goroutine of a closed coroutine is not released")
+	}
+	if msg := run(l, `
+		local coroutine = require 'coroutine'
+		local co = coroutine.running()
+		assert(not pcall(coroutine.close, co))
+		co = coroutine.wrap(function() assert(not pcall(coroutine.close, coroutine.running())) end)
+		co()
+	`); msg != nil {
+		t.Fatal(msg)
+	}
+
+	// The coroutines in reference cycles are released with their State.
+	waitGoroutines := func(what string) {
+		t.Helper()
+		for i := 0; i < 200 && runtime.NumGoroutine() > n; i++ {
+			runtime.GC()
+			time.Sleep(10 * time.Millisecond)
+		}
+		if m := runtime.NumGoroutine(); m > n {
+			t.Fatalf("%v: %v goroutines of suspended coroutines are not released", what, m-n)
+		}
+	}
+	cycle := `
+		local coroutine = require 'coroutine'
+		local obj = {}
+		obj.gen = coroutine.wrap(function() local o = obj coroutine.yield(1) end)
+		obj.gen()
+		rawset(_G, 'obj', obj)
+	`
+	for i := 0; i < 200; i++ {
+		if msg := run(util.NewState(), cycle); msg != nil {
+			t.Fatal(msg)
+		}
+	}
+	waitGoroutines("collected States")
+
+	// Or when the State is closed, or its context is done.
+	if msg := run(l, cycle); msg != nil {
+		t.Fatal(msg)
+	}
+	l.Close()
+	waitGoroutines("Close")
+	if msg := run(l, `assert(not pcall(obj.gen))`); msg != nil {
+		t.Fatal(msg)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	l.SetContext(ctx)
+	if msg := run(l, cycle); msg != nil {
+		t.Fatal(msg)
+	}
+	cancel()
+	waitGoroutines("SetContext")
+	l.SetContext(nil)
+}
+
+func TestPCallHandler(t *testing.T) {
+	l := util.NewState()
+	l.Push(func(l *lua.State) int {
+		// Level 0 is the handler, level 1 is error and level 2 is the chunk.
+		l.Push(l.Where(2) + " " + l.ToString(1))
+		return 1
+	})
+	if err := l.LoadText(strings.NewReader("local x = 1\nerror('boom')\n"), "chunk", 0); err != nil {
+		t.Fatal(err)
+	}
+	if msg := l.PCallHandler(0, 0, 1); msg != "chunk:2: boom" {
+		t.Fatalf("PCallHandler: got %v", msg)
+	}
+	if n := l.AbsIndex(-1); n != 1 {
+		t.Fatalf("PCallHandler: got %v values on the stack, want 1", n)
+	}
+}
+
+func run(l *lua.State, src string) interface{} {
+	if err := l.LoadText(strings.NewReader(src), "test", 0); err != nil {
+		return err
+	}
+	return l.PCall(0, 0, false)
+}
+
+func TestContext(t *testing.T) {
+	l := util.NewState()
+	ctx, cancel := context.WithCancel(context.Background())
+	l.SetContext(ctx)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	msg := run(l, "while true do pcall(function() while true do end end) end")
+	if err, ok := msg.(error); !ok || !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", msg, context.Canceled)
+	}
+
+	l.SetContext(context.Background())
+	if msg := run(l, "local x = 0 for i = 1, 10000 do x = x + i end"); msg != nil {
+		t.Fatal(msg)
+	}
+}
+
+func TestContextBlocking(t *testing.T) {
+	l := util.NewState()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	l.SetContext(ctx)
+
+	start := time.Now()
+	msg := run(l, "require('os').sleep(10000)")
+	if err, ok := msg.(error); !ok || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("os.sleep: got %v, want %v", msg, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("os.sleep: took %v", d)
+	}
+
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep is not available")
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	l.SetContext(ctx)
+	start = time.Now()
+	msg = run(l, "local p = require('os').popen('sleep', 'r', '10') require('io').read(p)")
+	if err, ok := msg.(error); !ok || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("io.read: got %v, want %v", msg, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("io.read: took %v", d)
+	}
+}
+
+func TestInstructionLimit(t *testing.T) {
+	l := util.NewState()
+	l.SetInstructionLimit(100000)
+	if msg := run(l, "local x = 0 for i = 1, 100 do x = x + i end"); msg != nil {
+		t.Fatal(msg)
+	}
+
+	l.SetInstructionLimit(100000)
+	if msg := run(l, "while true do pcall(function() while true do end end) end"); msg != lua.ErrInstructionLimit {
+		t.Fatalf("got %v, want %v", msg, lua.ErrInstructionLimit)
+	}
+	if msg := run(l, "local x = 1"); msg != lua.ErrInstructionLimit {
+		t.Fatalf("got %v, want %v", msg, lua.ErrInstructionLimit)
+	}
+
+	// "local x = 1" compiles to LOADK and RETURN.
+	l.SetInstructionLimit(2)
+	if msg := run(l, "local x = 1"); msg != nil {
+		t.Fatal(msg)
+	}
+	l.SetInstructionLimit(1)
+	if msg := run(l, "local x = 1"); msg != lua.ErrInstructionLimit {
+		t.Fatalf("got %v, want %v", msg, lua.ErrInstructionLimit)
+	}
+
+	l.SetInstructionLimit(0)
+	if msg := run(l, "local x = 0 for i = 1, 10000 do x = x + i end"); msg != nil {
+		t.Fatal(msg)
+	}
+}
+
+func TestAllocLimit(t *testing.T) {
+	l := util.NewState()
+	l.SetAllocLimit(1 << 20)
+	if msg := run(l, `
+		local string = require 'string'
+		local ok, msg = pcall(string.rep, 'x', 1e10)
+		assert(not ok and msg == 'not enough memory', msg)
+		assert(#string.rep('x', 1000) == 1000)
+	`); msg != nil {
+		t.Fatal(msg)
+	}
+
+	for _, src := range []string{
+		"local t = {} local i = 1 while true do t[i] = i i = i + 1 end",
+		"local t = {} local i = 1 while true do t[-i] = i i = i + 1 end",
+		"local s = 'x' while true do s = s .. s end",
+		"local t = {} for i = 1, 1e5 do t[i] = 'xxxxxxxxxx' end require('table').concat(t)",
+		"local io = require 'io' io.read(io.buffer('x'), 1e10)",
+		"local io = require 'io' io.read(io.buffer(require('string').rep('x', 1e6)))",
+	} {
+		l.SetAllocLimit(1 << 20)
+		if msg := run(l, src); msg != lua.ErrMemory {
+			t.Errorf("%v: got %v, want %v", src, msg, lua.ErrMemory)
+		}
+		if n := l.Allocated(); n > 1<<20 {
+			t.Errorf("%v: used %v bytes", src, n)
+		}
+	}
+
+	l.SetAllocLimit(0)
+	if msg := run(l, "local t = {} for i = 1, 1e5 do t[i] = i end"); msg != nil {
+		t.Fatal(msg)
+	}
+
+	// Traversals don't copy the keys.
+	if msg := run(l, "local t = {} for i = 1, 1000 do t['k' .. i] = i end rawset(_G, 'keys', t)"); msg != nil {
+		t.Fatal(msg)
+	}
+	l.SetAllocLimit(1 << 20)
+	if msg := run(l, `
+		local n = 0
+		for k in pairs(keys) do
+			for _ in pairs(keys) do break end
+			for _ in next, keys, k do n = n + 1 end
+		end
+		assert(n == 1000 * 999 / 2)
+	`); msg != nil {
+		t.Fatal(msg)
+	}
+	if n := l.Allocated(); n != 0 {
+		t.Errorf("pairs: used %v bytes", n)
+	}
+
+	// Freed memory is not subtracted, so a long-running State resets the budget between its calls.
+	l.SetAllocLimit(1 << 20)
+	for i := 0; i < 100; i++ {
+		l.ResetAlloc()
+		if msg := run(l, "for i = 1, 1e3 do local t = {} end"); msg != nil {
+			t.Fatalf("%v: %v", i, msg)
+		}
+	}
+	if n := l.Allocated(); n == 0 || n > 1<<20 {
+		t.Errorf("reset: used %v bytes", n)
+	}
+	if msg := run(l, "for i = 1, 1e5 do local t = {} end"); msg != lua.ErrMemory {
+		t.Errorf("got %v, want %v", msg, lua.ErrMemory)
+	}
+	if n := l.AllocLimit(); n != 1<<20 {
+		t.Errorf("limit: %v", n)
+	}
+}
+
+func TestHook(t *testing.T) {
+	l := util.NewState()
+	var lines []int
+	calls, returns := 0, 0
+	names := map[string]bool{}
+	l.SetHook(func(l *lua.State, event lua.HookEvent, line int) {
+		switch event {
+		case lua.HookLine:
+			if fr, _ := l.GetFrame(0); fr.Source == "test" {
+				lines = append(lines, line)
+			}
+		case lua.HookCall:
+			calls++
+			if fr, ok := l.GetFrame(0); ok && fr.Name != "" {
+				names[fr.Name] = true
+			}
+		case lua.HookReturn:
+			returns++
+		}
+	}, lua.MaskCall|lua.MaskReturn|lua.MaskLine, 0)
+
+	msg := run(l, `local function add(a, b)
+	return a + b
+end
+local x = 0
+for i = 1, 2 do
+	x = add(x, i)
+end
+tostring(x)
+`)
+	if msg != nil {
+		t.Fatal(msg)
+	}
+	want := []int{1, 4, 5, 6, 2, 5, 6, 2, 5, 8}
+	if fmt.Sprint(lines) != fmt.Sprint(want) {
+		t.Errorf("lines: got %v, want %v", lines, want)
+	}
+	if calls != returns || calls != 4 {
+		t.Errorf("got %v calls and %v returns, want 4", calls, returns)
+	}
+	if !names["add"] || !names["tostring"] {
+		t.Errorf("names: got %v", names)
+	}
+
+	count := 0
+	l.SetHook(func(l *lua.State, event lua.HookEvent, line int) {
+		if event != lua.HookCount {
+			t.Errorf("got %v event, want count", event)
+		}
+		count++
+	}, lua.MaskCount, 10)
+	// "local x = 1" compiles to LOADK and RETURN.
+	for i := 0; i < 20; i++ {
+		if msg := run(l, "local x = 1"); msg != nil {
+			t.Fatal(msg)
+		}
+	}
+	if count != 4 {
+		t.Errorf("count: got %v, want 4", count)
+	}
+
+	l.SetHook(nil, 0, 0)
+	count = 0
+	if msg := run(l, "local x = 0 for i = 1, 100 do x = x + i end"); msg != nil || count != 0 {
+		t.Fatalf("got %v and %v hooks after the hook is removed", msg, count)
+	}
+}
+
+func TestError(t *testing.T) {
+	l := util.NewState()
+	src := "local function f(x)\n\terror(x)\nend\nf('boom')\n"
+	if err := l.LoadText(strings.NewReader(src), "chunk", 0); err != nil {
+		t.Fatal(err)
+	}
+	msg := l.PCall(0, 0, true)
+	e, ok := msg.(*lua.Error)
+	if !ok {
+		t.Fatalf("got %T, want *lua.Error", msg)
+	}
+	if e.Error() != "boom" || e.Stack != nil {
+		t.Errorf("got %q with %v bytes of Go stack", e.Error(), len(e.Stack))
+	}
+	want := []lua.Frame{
+		{Name: "error", Source: "(native code)", Line: -1, LineDefined: -1, Native: true},
+		{Name: "f", Source: "chunk", Line: 2, LineDefined: 1},
+		{Source: "chunk", Line: 4},
+	}
+	if fmt.Sprint(e.Frames) != fmt.Sprint(want) {
+		t.Errorf("frames: got %v, want %v", e.Frames, want)
+	}
+
+	l.NativeTrace = true
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l.SetContext(ctx)
+	if err := l.LoadText(strings.NewReader("while true do end"), "chunk", 0); err != nil {
+		t.Fatal(err)
+	}
+	e = l.PCall(0, 0, true).(*lua.Error)
+	if !errors.Is(e, context.Canceled) {
+		t.Errorf("got %v, want %v", e, context.Canceled)
+	}
+	if len(e.Stack) == 0 || !strings.Contains(e.Traceback(), "Native Trace") {
+		t.Errorf("no Go stack in %v", e.Traceback())
+	}
+}
+
+func TestThread(t *testing.T) {
+	l := util.NewState()
+	if msg := run(l, `
+		local string = require 'string'
+		local counter = {n = 0}
+		rawset(_G, 'counter', counter)
+		rawset(_G, 'incr', function(s)
+			counter.n = counter.n + #string.format('%s', s)
+		end)
+	`); msg != nil {
+		t.Fatal(msg)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		th := l.NewThread()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				th.Lock()
+				th.Push("incr")
+				th.GetTable(lua.GlobalsIndex)
+				th.Unlock()
+				th.Push("x")
+				if msg := th.PCall(1, 0, false); msg != nil {
+					t.Error(msg)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	l.Lock()
+	if msg := run(l, "assert(counter.n == 800, counter.n)"); msg != nil {
+		t.Error(msg)
+	}
+	if msg := run(l, `
+		rawset(_G, 'obj', setmetatable({}, {
+			__add = function(a, b) counter.n = counter.n + b return a end,
+			__lt = function(a, b) counter.n = counter.n + 1 return false end,
+		}))
+	`); msg != nil {
+		t.Fatal(msg)
+	}
+	l.Unlock()
+
+	// Arith and Compare take the lock to run the meta methods.
+	for i := 0; i < 8; i++ {
+		th := l.NewThread()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			th.Lock()
+			th.Push("obj")
+			th.GetTable(lua.GlobalsIndex)
+			th.Unlock()
+			for j := 0; j < 100; j++ {
+				th.Push(1)
+				th.Arith(lua.OpAdd)
+				th.Compare(-1, -1, lua.OpLessThan)
+			}
+		}()
+	}
+	wg.Wait()
+
+	l.Lock()
+	if msg := run(l, "assert(counter.n == 2400, counter.n)"); msg != nil {
+		t.Error(msg)
+	}
+	l.Unlock()
+
+	th := l.NewThread()
+	th.Push(1)
+	th.Push(2)
+	l.Lock()
+	done := make(chan bool)
+	go func() {
+		th.Arith(lua.OpAdd)
+		done <- true
+	}()
+	select {
+	case <-done:
+		t.Error("Arith must wait for the lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	l.Unlock()
+	<-done
+
+	func() {
+		defer func() {
+			if e := recover(); e != lua.ErrNotLocked {
+				t.Errorf("CompareRaw: got %v, want %v", e, lua.ErrNotLocked)
+			}
+		}()
+		th.CompareRaw(-1, -1, lua.OpEqual)
+	}()
+
+	func() {
+		defer func() {
+			if e := recover(); e != lua.ErrNotLocked {
+				t.Errorf("got %v, want %v", e, lua.ErrNotLocked)
+			}
+		}()
+		l.Push("counter")
+		l.GetTable(lua.GlobalsIndex)
+	}()
+
+	// The lock belongs to the goroutine that holds it, not to the thread.
+	th.Lock()
+	go func() {
+		defer func() {
+			if e := recover(); e != lua.ErrNotLocked {
+				t.Errorf("another goroutine: got %v, want %v", e, lua.ErrNotLocked)
+			}
+			done <- true
+		}()
+		th.CompareRaw(-1, -1, lua.OpEqual)
+	}()
+	<-done
+	go func() {
+		th.Lock()
+		th.Unlock()
+		done <- true
+	}()
+	select {
+	case <-done:
+		t.Error("Lock must wait for the goroutine that holds the lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	th.Unlock()
+	<-done
+}
+
+func TestWeakTable(t *testing.T) {
+	l := util.NewState()
+	if msg := run(l, `
+		local keys = setmetatable({}, {__mode = 'k'})
+		local values = setmetatable({}, {__mode = 'v'})
+		local strong = {}
+		for i = 1, 100 do
+			keys[{}] = i
+			values[i] = {}
+			values['x' .. i] = function() return i end
+		end
+		keys[strong], values[101], values.s = 0, strong, 'string'
+		rawset(_G, 'weak', {keys = keys, values = values, strong = strong})
+		assert(#values == 101)
+	`); msg != nil {
+		t.Fatal(msg)
+	}
+	runtime.GC()
+	runtime.GC()
+	if msg := run(l, `
+		local keys, values, strong = weak.keys, weak.values, weak.strong
+		local n = 0
+		for k, v in pairs(keys) do
+			assert(k == strong and v == 0)
+			n = n + 1
+		end
+		assert(n == 1, n)
+		n = 0
+		for k, v in pairs(values) do
+			assert((k == 101 and v == strong) or (k == 's' and v == 'string'), k)
+			n = n + 1
+		end
+		assert(n == 2, n)
+		-- # counts the positive integer keys, only 101 is left.
+		assert(#values == 1, #values)
+		assert(values[101] == strong and keys[strong] == 0)
+		values[1] = 1
+		assert(#values == 2)
+	`); msg != nil {
+		t.Fatal(msg)
+	}
+}
+
+func TestFinalizer(t *testing.T) {
+	l := util.NewState()
+	closed := 0
+	l.Push(func(l *lua.State) int {
+		l.Push(struct{}{})
+		l.NewTable(0, 1)
+		l.Push("__gc")
+		l.Push(func(l *lua.State) int {
+			closed++
+			return 0
+		})
+		l.SetTableRaw(-3)
+		l.SetMetaTable(-2)
+		return 1
+	})
+	l.SetGlobal("newhandle")
+	if msg := run(l, `
+		local n = 0
+		local mt = {__gc = function(o)
+			assert(o.id)
+			n = n + 1
+		end}
+		for i = 1, 10 do
+			setmetatable({id = i}, mt)
+			newhandle()
+		end
+		setmetatable({id = 0}, {__gc = function() error('boom') end})
+		rawset(_G, 'finalized', function() return n end)
+
+		-- The keys removed from a table that is still alive are finalized.
+		local set = {}
+		for i = 11, 20 do
+			set[setmetatable({id = i}, mt)] = true
+		end
+		for k in pairs(set) do
+			set[k] = nil
+		end
+		rawset(_G, 'set', set)
+	`); msg != nil {
+		t.Fatal(msg)
+	}
+
+	var err error
+	for i := 0; i < 100 && (closed < 10 || err == nil); i++ {
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+		if e := l.RunFinalizers(); e != nil {
+			err = e
+		}
+	}
+	if closed != 10 {
+		t.Errorf("got %v userdata finalizers, want 10", closed)
+	}
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("got %v, want boom", err)
+	}
+	if msg := run(l, "assert(finalized() == 20, finalized())"); msg != nil {
+		t.Error(msg)
+	}
+
+	// Go never collects the finalizable values in reference cycles, see RunFinalizers.
+	if msg := run(l, `
+		local counts = {plain = 0, cycle = 0}
+		rawset(_G, 'counts', counts)
+		local plain = {__gc = function() counts.plain = counts.plain + 1 end}
+		local cycle = {__gc = function() counts.cycle = counts.cycle + 1 end}
+		for i = 1, 100 do
+			setmetatable({}, plain)
+			local a = setmetatable({}, cycle)
+			a.self = a
+		end
+	`); msg != nil {
+		t.Fatal(msg)
+	}
+	for i := 0; i < 100; i++ {
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+		l.RunFinalizers()
+	}
+	if msg := run(l, "assert(counts.plain == 100 and counts.cycle == 0, counts.plain .. ' ' .. counts.cycle)"); msg != nil {
+		t.Error(msg)
+	}
+}
+
+type point struct {
+	X, Y int
+}
+
+func (p *point) Add(q *point) *point {
+	return &point{p.X + q.X, p.Y + q.Y}
+}
+
+type shape struct {
+	Name   string
+	Origin point
+	Points []point
+	Tags   map[string]int
+	hidden int
+}
+
+func (s *shape) Move(dx, dy int) {
+	s.Origin.X += dx
+	s.Origin.Y += dy
+}
+
+func TestPushGo(t *testing.T) {
+	l := util.NewState()
+	s := &shape{
+		Name:   "tri",
+		Points: []point{{0, 0}, {1, 0}, {0, 1}},
+		Tags:   map[string]int{"a": 1},
+	}
+	l.PushGo(s)
+	l.SetGlobal("shape")
+	l.PushGo(&point{1, 2})
+	l.SetGlobal("point")
+	l.PushGo(fmt.Sprint)
+	l.SetGlobal("sprint")
+	l.PushGo(strconv.Atoi)
+	l.SetGlobal("atoi")
+
+	if msg := run(l, `
+		local string = require 'string'
+		assert(shape.Name == 'tri' and #shape.Points == 3)
+		shape.Name = 'triangle'
+		shape.Origin.X = 10
+		shape:Move(1, 2)
+		shape.Points[2].Y = 5
+		shape.Tags.b = 2
+		shape.Tags.a = nil
+		local n = 0
+		for k, v in pairs(shape.Tags) do
+			assert(k == 'b' and v == 2)
+			n = n + 1
+		end
+		assert(n == 1 and #shape.Tags == 1)
+
+		local p = point:Add(shape.Points[2])
+		assert(p.X == 2 and p.Y == 7)
+		assert(getmetatable(p) == getmetatable(point))
+		assert(shape.Points[4] == nil and shape.Origin == shape.Origin)
+		assert(sprint('a', 1, 2.5) == 'a1 2.5')
+
+		local v, msg = atoi('12')
+		assert(v == 12 and msg == nil)
+		v, msg = atoi('x')
+		assert(v == nil and string.find(msg, 'invalid syntax'))
+
+		local ok, msg = pcall(function() shape:Move('x') end)
+		assert(not ok and string.find(msg, "bad argument #2 to 'Move'"), msg)
+		assert(not pcall(function() return shape.hidden end))
+		assert(not pcall(function() shape.Name = {} end))
+	`); msg != nil {
+		t.Fatal(msg)
+	}
+
+	if s.Name != "triangle" || s.Origin != (point{11, 2}) || s.Points[1] != (point{1, 5}) || len(s.Tags) != 1 {
+		t.Errorf("got %+v", s)
+	}
+
+	// The unsigned integers larger than math.MaxInt64 are converted to floats.
+	l.PushGo(func() (uint64, uint64) { return math.MaxInt64, 1 << 63 })
+	l.SetGlobal("big")
+	if msg := run(l, `
+		local math = require 'math'
+		local a, b = big()
+		assert(a == math.maxinteger and math.type(b) == 'float' and b == 2^63)
+	`); msg != nil {
+		t.Error(msg)
+	}
+}
+
+func TestRegisterType(t *testing.T) {
+	l := util.NewState()
+	l.RegisterType("test.Counter", map[string]func(*lua.State) int{
+		"inc": func(l *lua.State) int {
+			c := l.CheckUserData(1, "test.Counter").(*int)
+			*c++
+			l.Push(*c)
+			return 1
+		},
+	})
+	n := 0
+	l.PushUserData(&n, "test.Counter")
+	l.SetGlobal("counter")
+	l.RegisterType("test.Other", nil)
+	l.PushUserData(&n, "test.Other")
+	l.SetGlobal("other")
+
+	if msg := run(l, `
+		local string = require 'string'
+		assert(counter:inc() == 1 and counter:inc() == 2)
+		assert(string.find(tostring(counter), '^test%.Counter: '))
+		local ok, msg = pcall(function() local n = counter.inc(other) end)
+		assert(not ok and string.find(msg, "bad argument #1 to 'inc' (test.Counter expected, got test.Other)", 1, true), msg)
+		ok, msg = pcall(function() local n = counter.inc() end)
+		assert(not ok and string.find(msg, "(test.Counter expected, got no value)", 1, true), msg)
+	`); msg != nil {
+		t.Fatal(msg)
+	}
+	if n != 2 {
+		t.Errorf("got %v, want 2", n)
+	}
+	if _, ok := l.TestUserData(-1, "test.Counter"); ok {
+		t.Error("TestUserData: got true on an empty stack")
+	}
+
+	closed := 0
+	l.RegisterType("test.Handle", map[string]func(*lua.State) int{
+		"__gc": func(l *lua.State) int {
+			closed++
+			return 0
+		},
+	})
+	for i := 0; i < 10; i++ {
+		l.PushUserData(i, "test.Handle")
+		l.Pop(1)
+	}
+	for i := 0; i < 100 && closed < 10; i++ {
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+		if err := l.RunFinalizers(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if closed != 10 {
+		t.Errorf("got %v finalizers of pushed userdata, want 10", closed)
+	}
+}
+
+type server struct {
+	Host string `lua:"host"`
+	Port int    `lua:"port,omitempty"`
+}
+
+type config struct {
+	Name    string            `lua:"name"`
+	Servers []server          `lua:"servers"`
+	Limits  map[string]uint16 `lua:"limits"`
+	Main    *server           `lua:"main"`
+	Extra   interface{}       `lua:"extra"`
+	Skip    int               `lua:"-"`
+	Next    *config           `lua:"next,omitempty"`
+}
+
+func TestMarshal(t *testing.T) {
+	l := util.NewState()
+	if msg := run(l, `
+		rawset(_G, 'cfg', {
+			name = 'app',
+			servers = {{host = 'a', port = 1}, {host = 'b'}},
+			limits = {cpu = 2},
+			main = {host = 'm', port = 80},
+			extra = {1, 'x', {k = true}},
+			Skip = 5,
+			unknown = 1,
+		})
+		rawset(_G, 'bad', {servers = {{host = 'a'}, {port = 'x'}}})
+	`); msg != nil {
+		t.Fatal(msg)
+	}
+
+	var c config
+	l.Push("cfg")
+	l.GetTable(lua.GlobalsIndex)
+	if err := l.ToGo(-1, &c); err != nil {
+		t.Fatal(err)
+	}
+	l.Pop(1)
+	extra := []interface{}{int64(1), "x", map[string]interface{}{"k": true}}
+	if c.Name != "app" || len(c.Servers) != 2 || c.Servers[1] != (server{"b", 0}) || c.Limits["cpu"] != 2 ||
+		*c.Main != (server{"m", 80}) || fmt.Sprint(c.Extra) != fmt.Sprint(extra) || c.Skip != 0 {
+		t.Errorf("got %+v", c)
+	}
+
+	l.Push("bad")
+	l.GetTable(lua.GlobalsIndex)
+	var b config
+	err := l.ToGo(-1, &b)
+	if err == nil || err.Error() != "servers[2].port: cannot use string as int" {
+		t.Errorf("got %v", err)
+	}
+	if err := l.ToGo(-1, b); err == nil {
+		t.Error("got nil error for a non-pointer")
+	}
+	l.Pop(1)
+
+	c.Next = &c
+	l.PushValue(&c)
+	l.SetGlobal("value")
+	l.PushValue(map[int][]byte{1: []byte("a"), 3: nil})
+	l.SetGlobal("bytes")
+	if msg := run(l, `
+		assert(value.name == 'app' and value.main.port == 80 and value.Skip == nil)
+		assert(#value.servers == 2 and value.servers[2].host == 'b' and value.servers[2].port == nil)
+		assert(value.next == value and value.extra[3].k == true)
+		assert(bytes[1] == 'a' and bytes[3] == nil)
+	`); msg != nil {
+		t.Error(msg)
+	}
+
+	// The unsigned integers larger than math.MaxInt64 are converted to floats.
+	l.PushValue([]uint64{math.MaxInt64, 1 << 63, math.MaxUint64})
+	l.SetGlobal("big")
+	if msg := run(l, `
+		local math = require 'math'
+		assert(big[1] == math.maxinteger and math.type(big[2]) == 'float' and big[2] == 2^63 and big[3] == 2^64)
+	`); msg != nil {
+		t.Error(msg)
+	}
+	l.Push("big")
+	l.GetTable(lua.GlobalsIndex)
+	var big []uint64
+	if err := l.ToGo(-1, &big); err == nil || len(big) != 3 || big[1] != 1<<63 {
+		t.Errorf("got %v and %v, want an error for 2^64", big, err)
+	}
+	l.Pop(1)
+
+	l.PushGo(func(c config) string { return c.Name + ":" + c.Main.Host })
+	l.SetGlobal("describe")
+	if msg := run(l, `assert(describe({name = 'x', main = {host = 'y'}}) == 'x:y')`); msg != nil {
+		t.Error(msg)
+	}
+}
+
+func TestFunction(t *testing.T) {
+	l := util.NewState()
+	if msg := run(l, `
+		rawset(_G, 'add', function(a, b) return a + b, {a, b} end)
+		rawset(_G, 'fail', function(msg) error(msg) end)
+		rawset(_G, 'adder', function(n) return function(x) return x + n end end)
+		rawset(_G, 'apply', nil)
+	`); msg != nil {
+		t.Fatal(msg)
+	}
+	fn := func(name string) *lua.Function {
+		l.Push(name)
+		l.GetTable(lua.GlobalsIndex)
+		defer l.Pop(1)
+		return l.Function(-1)
+	}
+
+	add := fn("add")
+	rtns, err := add.Call(1, 2.5)
+	if err != nil || len(rtns) != 2 || rtns[0] != 3.5 || fmt.Sprint(rtns[1]) != "[1 2.5]" {
+		t.Errorf("got %v, %v", rtns, err)
+	}
+
+	_, err = fn("fail").Call("boom")
+	if e, ok := err.(*lua.Error); !ok || !strings.Contains(e.Error(), "boom") {
+		t.Errorf("got %v", err)
+	}
+
+	sum := lua.Bind[func(int, int) int](add)
+	if n := sum(2, 3); n != 5 {
+		t.Errorf("got %v, want 5", n)
+	}
+	try := lua.Bind[func(...interface{}) (string, error)](fn("fail"))
+	if _, err := try("oops"); err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("got %v", err)
+	}
+	conv := lua.Bind[func(int, int) ([]int, error)](add)
+	if _, err := conv(1, 2); err == nil || !strings.Contains(err.Error(), "result #1") {
+		t.Errorf("got %v", err)
+	}
+
+	rtns, err = fn("adder").Call(10)
+	inc, ok := rtns[0].(*lua.Function)
+	if err != nil || !ok {
+		t.Fatalf("got %v, %v", rtns, err)
+	}
+	if n := lua.Bind[func(int) int](inc)(1); n != 11 {
+		t.Errorf("got %v, want 11", n)
+	}
+	var adder func(int) func(int) int
+	l.Push("adder")
+	l.GetTable(lua.GlobalsIndex)
+	if err := l.ToGo(-1, &adder); err != nil {
+		t.Fatal(err)
+	}
+	l.Pop(1)
+	if n := adder(5)(6); n != 11 {
+		t.Errorf("got %v, want 11", n)
+	}
+
+	l.PushGo(func(f func(int) int, x int) int { return f(x) * 2 })
+	l.SetGlobal("apply")
+	l.PushGo(inc)
+	l.SetGlobal("inc")
+	if msg := run(l, `assert(apply(function(x) return x + 1 end, 3) == 8 and inc(1) == 11)`); msg != nil {
+		t.Error(msg)
+	}
+
+	inc.Release()
+	if _, err := inc.Call(1); err == nil {
+		t.Error("got nil error for a released function")
+	}
+
+	// Calls from different goroutines take turns, run with -race to check it.
+	if msg := run(l, `
+		local n = 0
+		rawset(_G, 'count', function(x) n = n + x return n end)
+	`); msg != nil {
+		t.Fatal(msg)
+	}
+	count := fn("count")
+	bound := lua.Bind[func(int) int](count)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := count.Call(1); err != nil {
+					t.Error(err)
+					return
+				}
+				bound(2)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := bound(0); n != 2400 {
+		t.Errorf("got %v, want 2400", n)
+	}
+}
+
+func TestTruncatedDivision(t *testing.T) {
+	l := util.NewState()
+	l.SetTruncatedDivision(true)
+	if msg := run(l, `assert((-1) % 5 == -1 and (-1.5) % 1 == -0.5 and (-7) // 2 == -3)`); msg != nil {
+		t.Error(msg)
+	}
+	l.SetTruncatedDivision(false)
+	if msg := run(l, `assert((-1) % 5 == 4 and (-1.5) % 1 == 0.5 and (-7) // 2 == -4)`); msg != nil {
+		t.Error(msg)
+	}
+}
+
+func TestFolding(t *testing.T) {
+	l := util.NewState()
+	count := 0
+	l.SetHook(func(l *lua.State, event lua.HookEvent, line int) {
+		count++
+	}, lua.MaskCount, 1)
+	// The folded expressions compile to LOADK and RETURN, like "local x = 1".
+	for _, src := range []string{"local x = 60*60*24", "local x = 'a'..'b'..'c'", "local x = -(2^10 | 3)"} {
+		count = 0
+		if msg := run(l, src); msg != nil {
+			t.Fatal(msg)
+		}
+		if count != 2 {
+			t.Errorf("%v: got %v instructions, want 2", src, count)
+		}
+	}
+	l.SetHook(nil, 0, 0)
+
+	// The result of % and // depends on the State, so they are not folded.
+	p, err := lua.Compile("return (-7) // 2, (-1) % 5", "fold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		trunc    bool
+		div, mod int64
+	}{{true, -3, -1}, {false, -4, 4}} {
+		l.SetTruncatedDivision(c.trunc)
+		if err := l.PushProto(p, 0); err != nil {
+			t.Fatal(err)
+		}
+		l.Call(0, 2)
+		if div, mod := l.ToInteger(-2), l.ToInteger(-1); div != c.div || mod != c.mod {
+			t.Errorf("truncated %v: got %v and %v, want %v and %v", c.trunc, div, mod, c.div, c.mod)
+		}
+		l.Pop(2)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	l := util.NewState()
+	if msg := run(l, `load('return 1')`); msg == nil || !strings.Contains(fmt.Sprint(msg), "load: disabled") {
+		t.Fatalf("load should be disabled by default, got %v", msg)
+	}
+
+	if err := l.LoadText(strings.NewReader("return 1 + 2"), "bin", 0); err != nil {
+		t.Fatal(err)
+	}
+	l.Push("bin")
+	l.Push(string(l.Dump(-2, false)))
+	l.SetTableRaw(lua.GlobalsIndex)
+	l.Pop(1)
+
+	l.SetLoadMode("t")
+	if msg := run(l, `
+		local f = assert(load('return x + 1', 'expr', 't', {x = 41}))
+		assert(f() == 42)
+		local parts, i = {'return ', '1 ', '+ 1'}, 0
+		f = assert(load(function() i = i + 1; return parts[i] end))
+		assert(f() == 2)
+		local f, err = load('return +')
+		assert(f == nil and type(err) == 'string')
+		f, err = load(function() return 1 end)
+		assert(f == nil and err == 'reader function must return a string')
+		f, err = load('return 1', 'x', 'b')
+		assert(f == nil and err == "attempt to load a text chunk (mode is 'b')")
+		f, err = load(bin)
+		assert(f == nil and err == "attempt to load a binary chunk (mode of the host is 't')")
+		assert(not pcall(load, 'return 1', 'x', 't', 1))
+		assert(load('return require', 'x', 't')() == require)
+		f = assert(load('return require', 'x', 't', nil))
+		local ok, err = pcall(f)
+		assert(not ok and require('string').find(err, 'not a table'), err)
+		assert(load('return 1', 'x', 't', nil)() == 1)
+	`); msg != nil {
+		t.Fatal(msg)
+	}
+
+	l.SetLoadMode("bt")
+	if msg := run(l, `
+		assert(load(bin)() == 3)
+		local f, err = load(bin, 'bin', 't')
+		assert(f == nil and err == "attempt to load a binary chunk (mode is 't')")
+	`); msg != nil {
+		t.Fatal(msg)
+	}
+
+	l.SetInstructionLimit(100000)
+	if msg := run(l, `load('while true do end')()`); msg == nil {
+		t.Fatal("the instruction limit should apply to loaded chunks")
+	}
+	l.SetInstructionLimit(0)
+}
+
+func TestPolicy(t *testing.T) {
+	l := lua.NewState()
+	util.Strict(l)
+	util.OpenWith(l, util.Sandbox)
+	if msg := run(l, `
+		local os, string = require 'os', require 'string'
+		assert(type(os.date('%Y')) == 'string')
+		assert(not pcall(require, 'io'))
+		assert(not pcall(require, 'package'))
+		local ok, msg = pcall(os.remove, 'x')
+		assert(not ok and msg:find('permission denied: write files', 1, true), msg)
+		ok, msg = pcall(os.open, 'x')
+		assert(not ok and msg:find('permission denied: read files', 1, true), msg)
+		ok, msg = pcall(os.execute, 'true')
+		assert(not ok and msg:find('permission denied: run programs', 1, true), msg)
+		ok, msg = pcall(os.exit)
+		assert(not ok and msg:find('permission denied: exit', 1, true), msg)
+		ok, msg = pcall(os.getenv, 'HOME')
+		assert(not ok and msg:find("permission denied: read environment variable 'HOME'", 1, true), msg)
+		assert(not pcall(load, 'return 1'))
+	`); msg != nil {
+		t.Fatal(msg)
+	}
+
+	dir := t.TempDir()
+	l = lua.NewState()
+	util.Strict(l)
+	util.OpenWith(l, util.Policy{
+		Disable: []string{"print", "os.tmpname"},
+		Load:    "t",
+		OS:      lmodos.Policy{Files: lmodos.ReadWrite, Env: []string{"HOME"}},
+	})
+	l.Push("dir")
+	l.Push(dir)
+	l.SetTableRaw(lua.GlobalsIndex)
+	if msg := run(l, `
+		local os, io = require 'os', require 'io'
+		assert(rawget(_G, 'print') == nil and os.tmpname == nil)
+		assert(load('return 1')() == 1)
+		os.getenv('HOME')
+		assert(not pcall(os.getenv, 'PATH'))
+		local p = os.join(dir, 'a.txt')
+		assert(io.writefile(p, 'abc') == nil)
+		rawset(_G, 'p', p)
+		rawset(_G, 'f', os.open(p))
+		rawset(_G, 'writefile', io.writefile)
+		rawset(_G, 'remove', os.remove)
+	`); msg != nil {
+		t.Fatal(msg)
+	}
+
+	// The functions and handles that scripts kept are restricted too.
+	lmodos.SetPolicy(l, lmodos.Policy{Files: lmodos.ReadOnly})
+	if msg := run(l, `
+		local io, string = require 'io', require 'string'
+		assert(io.read(f) == 'abc' and io.readfile(p) == 'abc')
+		assert(not pcall(writefile, p, 'x'))
+		assert(not pcall(remove, p))
+		local ok, msg = pcall(function() io.stdout = f end)
+		assert(not ok and msg:find('permission denied: replace standard files', 1, true), msg)
+	`); msg != nil {
+		t.Fatal(msg)
+	}
+	if p := lmodos.GetPolicy(l); p.Files != lmodos.ReadOnly || p.Exec {
+		t.Fatalf("unexpected policy: %+v", p)
+	}
+
+	// So are the handles that the host gives, except the standard files.
+	w, err := os.Create(filepath.Join(dir, "b.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	lmodos.SetPolicy(l, lmodos.Policy{})
+	l.Push("w")
+	l.PushUserData(w, "os.File")
+	l.SetTableRaw(lua.GlobalsIndex)
+	if msg := run(l, `
+		local io, package = require 'io', require 'package'
+		local ok, msg = pcall(io.write, w, 'x')
+		assert(not ok and msg:find('permission denied: write files', 1, true), msg)
+		ok, msg = pcall(io.copy, f, w)
+		assert(not ok and msg:find('permission denied: read files', 1, true), msg)
+		assert(not pcall(io.read, f))
+		assert(not pcall(io.scanner, f))
+		assert(not pcall(io.limit, f, 1))
+		assert(not pcall(f.seek, f))
+		assert(not pcall(f.close, f))
+		assert(io.write(io.stdout, '') == 0)
+		ok, msg = pcall(package.searchpath, 'a', p)
+		assert(not ok and msg:find('permission denied: read files', 1, true), msg)
+	`); msg != nil {
+		t.Fatal(msg)
+	}
+	if info, err := w.Stat(); err != nil || info.Size() != 0 {
+		t.Fatalf("unexpected write: %v, %v", info, err)
+	}
+}
+
+func TestSearcher(t *testing.T) {
+	l := util.NewState()
+	lmodbase.AddSearcher(l, func(l *lua.State) int {
+		name := l.CheckString(1)
+		if !strings.HasPrefix(name, "db.") {
+			l.Push("\n\tno record '" + name + "'")
+			return 1
+		}
+		l.Push(func(l *lua.State) int {
+			l.Push(l.ToString(2) + ":" + l.ToString(1))
+			return 1
+		})
+		l.Push("db")
+		return 2
+	})
+	if msg := run(l, `
+		local string = require 'string'
+		assert(require 'db.users' == 'db:db.users')
+		local ok, msg = pcall(require, 'users')
+		assert(not ok and string.find(msg, "\n\tno record 'users'", 1, true), msg)
+	`); msg != nil {
+		t.Fatal(msg)
+	}
+}
+
+func TestFS(t *testing.T) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, src := range map[string]string{
+		"lib/util.lua":     `return {zip = true}`,
+		"shared.lua":       `return 'zip'`,
+		"app/init.lua":     `rawset(_G, 'result', require('lib.util').zip and require('shared') .. require('mod'))`,
+		"broken/init.lua":  `return +`,
+		"lib/mod/init.lua": `return 'unused'`,
+	} {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(src))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := util.NewState()
+	lmodbase.AddFS(l, fstest.MapFS{
+		"shared.lua":   {Data: []byte(`return 'map'`)},
+		"mod/init.lua": {Data: []byte(`return ':init'`)},
+	})
+	lmodbase.AddFS(l, z)
+	if err := util.Run(l, "app"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := run(l, `
+		local string = require 'string'
+		assert(result == 'map:init', result)
+		local ok, msg = pcall(require, 'broken')
+		assert(not ok and string.find(msg, "error loading module 'broken' from file 'broken/init.lua'", 1, true), msg)
+		ok, msg = pcall(require, 'none')
+		assert(not ok and string.find(msg, "no file 'none.lua' in file system #1", 1, true), msg)
+		assert(string.find(msg, "no file 'none/init.lua' in file system #2", 1, true), msg)
+	`); msg != nil {
+		t.Fatal(msg)
+	}
+	if err := util.Run(l, "./lib/util.lua"); err != nil {
+		t.Fatal(err)
+	}
+	if err := util.Run(l, "none.lua"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("got %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		dir := t.TempDir()
+		src := fmt.Sprintf("return 'app%v'", i)
+		if err := os.WriteFile(dir+"/app.lua", []byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(i int, dir string) {
+			defer wg.Done()
+			var out, errs bytes.Buffer
+			l := util.NewState(util.Options{
+				Paths:  []string{dir},
+				FS:     []fs.FS{fstest.MapFS{"lib.lua": {Data: []byte(fmt.Sprintf("return %v", i))}}},
+				Root:   dir,
+				Stdout: &out,
+				Stderr: &errs,
+			})
+			for j := 0; j < 50; j++ {
+				if msg := run(l, fmt.Sprintf(`
+					local os, io = require 'os', require 'io'
+					assert(require 'app' == 'app%[1]v' and require 'lib' == %[1]v)
+					assert(os.root == %[2]q)
+					print('out', %[1]v)
+					io.write(io.stderr, 'err%[1]v')
+					io.stdout = io.buffer()
+					io.write(io.stdout, 'hidden')
+				`, i, dir)); msg != nil {
+					t.Error(msg)
+					return
+				}
+			}
+			if want := strings.Repeat(fmt.Sprintf("out\t%v\n", i), 50); out.String() != want {
+				t.Errorf("state %v: print wrote %q", i, out.String())
+			}
+			if want := strings.Repeat(fmt.Sprintf("err%v", i), 50); errs.String() != want {
+				t.Errorf("state %v: io.stderr got %q", i, errs.String())
+			}
+		}(i, dir)
+	}
+	wg.Wait()
+	if os.Stdout == nil || os.Stderr == nil {
+		t.Fatal("the standard files of the process were replaced")
+	}
+
+	l := lua.NewState()
+	if err := lmodos.SetStdio(l, "stdin", 42); err == nil {
+		t.Fatal("SetStdio: want an error for a stdin that isn't an io.Reader")
+	}
+	if err := lmodos.SetStdio(l, "stdlog", os.Stderr); err == nil {
+		t.Fatal("SetStdio: want an error for an unknown name")
+	}
+	var out bytes.Buffer
+	if err := lmodos.SetStdio(l, "stdout", &out); err != nil || lmodos.GetOptions(l).Stdout != &out {
+		t.Fatalf("SetStdio: %v", err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("NewState: want a panic for more than one Options")
+			}
+		}()
+		util.NewState(util.Options{}, util.Options{})
+	}()
+
+	// The deprecated global settings are still the defaults.
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/old.lua", []byte("return 'old'"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	defer func(paths []string) { lmodbase.Paths = paths }(lmodbase.Paths)
+	util.AddPath(dir)
+	if util.Root != lmodos.Root {
+		t.Fatalf("util.Root: got %q, want %q", util.Root, lmodos.Root)
+	}
+	if msg := run(util.NewState(), fmt.Sprintf(`
+		local os = require 'os'
+		assert(require 'old' == 'old' and os.root == %q)
+	`, lmodos.Root)); msg != nil {
+		t.Fatal(msg)
+	}
+}
+
+func TestProto(t *testing.T) {
+	if _, err := lua.Compile("return +", "bad"); err == nil {
+		t.Fatal("Compile: want an error")
+	}
+	p, err := lua.Compile("local x = ... return (y or 0) + x", "proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name() != "proto" {
+		t.Fatalf("Name: got %q", p.Name())
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			l := lua.NewState()
+			l.NewTable(0, 1)
+			l.Push("y")
+			l.Push(i)
+			l.SetTableRaw(-3)
+			for j := 0; j < 100; j++ {
+				if err := l.PushProto(p, 1); err != nil {
+					t.Error(err)
+					return
+				}
+				l.Push(j)
+				l.Call(1, 1)
+				if n := l.ToInteger(-1); n != int64(i+j) {
+					t.Errorf("got %v, want %v", n, i+j)
+				}
+				l.Pop(1)
+			}
+			if err := l.PushProto(p, 0); err != nil || l.TypeOf(-1) != lua.TypeFunction {
+				t.Errorf("PushProto with the global table: %v", err)
+			}
+			l.Push(1)
+			if err := l.PushProto(p, -1); err == nil {
+				t.Error("PushProto: want an error for an environment that is not a table")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var c lua.Cache
+	reads := 0
+	src := []byte("return 1")
+	read := func() ([]byte, error) {
+		reads++
+		return src, nil
+	}
+	mtime := time.Now()
+	p1, _ := c.Get("a.lua", mtime, read)
+	p2, _ := c.Get("a.lua", mtime, read)
+	if p1 != p2 || reads != 1 {
+		t.Fatalf("same modification time: got %v reads, same chunk %v", reads, p1 == p2)
+	}
+	p2, _ = c.Get("a.lua", time.Time{}, read)
+	if p1 != p2 || reads != 2 {
+		t.Fatalf("same source: got %v reads, same chunk %v", reads, p1 == p2)
+	}
+	src = []byte("return 2")
+	if p2, _ = c.Get("a.lua", time.Time{}, read); p1 == p2 {
+		t.Fatal("changed source: got the old chunk")
+	}
+	src = []byte("return +")
+	if _, err := c.Get("a.lua", mtime.Add(time.Second), read); err == nil {
+		t.Fatal("Get: want a compile error")
+	}
+	c.Remove("a.lua")
+
+	// Chunks with the same name are kept apart by their keys.
+	srcs := map[string][]byte{"fs1": []byte("return 1"), "fs2": []byte("return 2")}
+	get := func(key string) *lua.Proto {
+		p, err := c.GetKey(key, "lib.lua", time.Time{}, func() ([]byte, error) {
+			reads++
+			return srcs[key], nil
+		})
+		if err != nil || p.Name() != "lib.lua" {
+			t.Fatalf("GetKey %v: %v", key, err)
+		}
+		return p
+	}
+	p1, p2 = get("fs1"), get("fs2")
+	if get("fs1") != p1 || get("fs2") != p2 || p1 == p2 {
+		t.Fatal("GetKey: the chunks of different keys should be cached apart")
+	}
+
+	// A bounded cache removes the chunks used least recently.
+	c = lua.Cache{Max: 2}
+	p1 = get("fs1")
+	get("fs2")
+	get("fs1")
+	srcs["fs3"] = []byte("return 3")
+	p3 := get("fs3")
+	if c.Len() != 2 || get("fs1") != p1 || get("fs3") != p3 {
+		t.Fatalf("Max: got %v chunks", c.Len())
+	}
+
+	// The modules of different file systems don't share cached chunks.
+	n := lua.DefaultCache.Len()
+	for i := 0; i < 2; i++ {
+		l := util.NewState(util.Options{
+			FS: []fs.FS{fstest.MapFS{"cachedfs.lua": {Data: []byte(fmt.Sprintf("return %v", i))}}},
+		})
+		if msg := run(l, fmt.Sprintf(`assert(require 'cachedfs' == %v)`, i)); msg != nil {
+			t.Fatal(msg)
+		}
+	}
+	if lua.DefaultCache.Len() != n+2 {
+		t.Fatalf("DefaultCache: got %v new chunks, want 2", lua.DefaultCache.Len()-n)
+	}
+
+	// require compiles each version of a module once.
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cached.lua")
+	if err := os.WriteFile(path, []byte("return 'cached'"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		l := util.NewState(util.Options{Paths: []string{dir}})
+		if msg := run(l, `assert(require 'cached' == 'cached')`); msg != nil {
+			t.Fatal(msg)
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lua.DefaultCache.Get(path, info.ModTime(), func() ([]byte, error) {
+		return nil, errors.New("the module should be cached")
+	}); err != nil {
+		t.Fatal(err)
+	}
 }
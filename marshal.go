@@ -0,0 +1,433 @@
+/*
+Copyright 2019 by ofunc
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// maxDepth limits the nesting of tables decoded by ToGo, so cyclic tables raise an error.
+const maxDepth = 200
+
+// ToGo decodes the value at index i into the Go value that dst points to.
+//
+// Tables are decoded into structs, maps, slices and arrays, and into interface{} as []interface{} if they are
+// a non-empty sequence, or as map[string]interface{} (map[interface{}]interface{} if a key is not a string).
+// Struct fields are read from the key named by the `lua:"name"` tag, or by the field name if there is no tag,
+// fields tagged with "-" and keys that are not fields are ignored. Pointers are allocated as needed.
+// Tables are read raw, without meta methods.
+//
+// Functions are decoded into *Function, into interface{} as *Function, and into other function types with Bind.
+// Other values are converted like the arguments of functions pushed by PushGo.
+// The error contains the path of the value that could not be decoded, such as "servers[2].port",
+// in that case dst may be partially filled.
+func (l *State) ToGo(i int, dst interface{}) error {
+	l.checkLock()
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("ToGo: non-nil pointer expected, got %T", dst)
+	}
+	return l.decode(l.get(i), rv.Elem(), "", 0)
+}
+
+// PushValue pushes a Go value, converting it deeply into Lua values.
+//
+// Structs and maps are converted to tables, struct fields are named like in ToGo,
+// and the "omitempty" tag option skips zero fields, as in `lua:"name,omitempty"`.
+// Slices and arrays are converted to sequences, except []byte which is converted to a string.
+// Pointers that are reached more than once are converted to the same table, so cycles are preserved.
+// Lua values are pushed as they are, and values that have no Lua form, such as functions and channels,
+// are pushed with PushGo.
+func (l *State) PushValue(v interface{}) {
+	l.checkLock()
+	l.stack.Push(l.encode(reflect.ValueOf(v), make(map[seenKey]*table)))
+}
+
+// luaField is a struct field as seen from Lua.
+type luaField struct {
+	name      string
+	index     []int
+	omitempty bool
+}
+
+// luaFields returns the exported fields of the struct type t, including promoted fields.
+func luaFields(t reflect.Type) []luaField {
+	var fields []luaField
+	for _, f := range reflect.VisibleFields(t) {
+		tag, tagged := f.Tag.Lookup("lua")
+		if !f.IsExported() || tag == "-" || f.Anonymous && !tagged {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, luaField{name: name, index: f.Index, omitempty: opts == "omitempty"})
+	}
+	return fields
+}
+
+// pathError adds the path of the decoded value to err.
+func pathError(path string, err error) error {
+	if path == "" {
+		return err
+	}
+	return fmt.Errorf("%v: %w", path, err)
+}
+
+// fieldPath returns the path of the field name of path.
+func fieldPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// keyPath returns the path of the key k of path.
+func keyPath(path string, k value) string {
+	if s, ok := k.(string); ok {
+		return fmt.Sprintf("%v[%q]", path, s)
+	}
+	return fmt.Sprintf("%v[%v]", path, toString(k))
+}
+
+// decode converts the Lua value v into rv, which must be settable.
+func (l *State) decode(v value, rv reflect.Value, path string, depth int) error {
+	if depth > maxDepth {
+		return pathError(path, errors.New("value too deeply nested"))
+	}
+	t := rv.Type()
+	if u, ok := v.(*userdata); ok {
+		if x := reflect.ValueOf(u.data); x.IsValid() && x.Type().AssignableTo(t) {
+			rv.Set(x)
+			return nil
+		}
+	}
+
+	if fn, ok := v.(*function); ok {
+		switch {
+		case fn.native != nil && reflect.TypeOf(fn.native).AssignableTo(t):
+			rv.Set(reflect.ValueOf(fn.native))
+			return nil
+		case t == functionType || t.Kind() == reflect.Interface && t.NumMethod() == 0:
+			rv.Set(reflect.ValueOf(l.newFunction(fn)))
+			return nil
+		case t.Kind() == reflect.Func:
+			rv.Set(l.newFunction(fn).makeFunc(t))
+			return nil
+		}
+	}
+
+	tbl, _ := v.(*table)
+	switch t.Kind() {
+	case reflect.Bool:
+		rv.SetBool(toBoolean(v))
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i, err := tryInteger(v); err == nil && !rv.OverflowInt(i) {
+			rv.SetInt(i)
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if i, err := tryInteger(v); err == nil && i >= 0 && !rv.OverflowUint(uint64(i)) {
+			rv.SetUint(uint64(i))
+			return nil
+		}
+		// The integers larger than math.MaxInt64 are floats in Lua, see fromUint.
+		if f, ok := v.(float64); ok && f >= 1<<63 && f < 1<<64 && f == math.Trunc(f) && !rv.OverflowUint(uint64(f)) {
+			rv.SetUint(uint64(f))
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		if f, err := tryFloat(v); err == nil {
+			rv.SetFloat(f)
+			return nil
+		}
+	case reflect.String:
+		switch v.(type) {
+		case string, int64, float64:
+			rv.SetString(toString(v))
+			return nil
+		}
+	case reflect.Interface:
+		switch x := v.(type) {
+		case nil:
+			rv.Set(reflect.Zero(t))
+			return nil
+		case bool, int64, float64, string:
+			if x := reflect.ValueOf(x); x.Type().Implements(t) {
+				rv.Set(x.Convert(t))
+				return nil
+			}
+		case *table:
+			if t.NumMethod() == 0 {
+				x, err := l.decodeAny(x, path, depth)
+				if err == nil {
+					rv.Set(reflect.ValueOf(x))
+				}
+				return err
+			}
+		}
+	case reflect.Ptr:
+		if v == nil {
+			rv.Set(reflect.Zero(t))
+			return nil
+		}
+		if rv.IsNil() {
+			rv.Set(reflect.New(t.Elem()))
+		}
+		return l.decode(v, rv.Elem(), path, depth+1)
+	case reflect.Map:
+		if v == nil {
+			rv.Set(reflect.Zero(t))
+			return nil
+		}
+		if tbl != nil {
+			return l.decodeMap(tbl, rv, path, depth)
+		}
+	case reflect.Slice:
+		switch x := v.(type) {
+		case nil:
+			rv.Set(reflect.Zero(t))
+			return nil
+		case string:
+			if t.Elem().Kind() == reflect.Uint8 {
+				rv.SetBytes([]byte(x))
+				return nil
+			}
+		case *table:
+			n := x.Length()
+			rv.Set(reflect.MakeSlice(t, n, n))
+			return l.decodeSeq(x, rv, path, depth)
+		}
+	case reflect.Array:
+		if tbl != nil {
+			if n := tbl.Length(); n > rv.Len() {
+				return pathError(path, fmt.Errorf("cannot use table of length %v as %v", n, t))
+			}
+			return l.decodeSeq(tbl, rv, path, depth)
+		}
+	case reflect.Struct:
+		if tbl != nil {
+			return l.decodeStruct(tbl, rv, path, depth)
+		}
+	case reflect.Func, reflect.Chan:
+		if v == nil {
+			rv.Set(reflect.Zero(t))
+			return nil
+		}
+	}
+	return pathError(path, fmt.Errorf("cannot use %v as %v", goTypeName(v), t))
+}
+
+// decodeSeq decodes the sequence tbl into the slice or array rv, elements past the end of tbl are zeroed.
+func (l *State) decodeSeq(tbl *table, rv reflect.Value, path string, depth int) error {
+	for i := 0; i < rv.Len(); i++ {
+		v := tbl.Get(int64(i + 1))
+		if v == nil {
+			rv.Index(i).Set(reflect.Zero(rv.Type().Elem()))
+			continue
+		}
+		if err := l.decode(v, rv.Index(i), fmt.Sprintf("%v[%v]", path, i+1), depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *State) decodeMap(tbl *table, rv reflect.Value, path string, depth int) error {
+	t := rv.Type()
+	if rv.IsNil() {
+		rv.Set(reflect.MakeMapWithSize(t, tbl.Count()))
+	}
+	for k, v, _ := tbl.Next(nil); k != nil; k, v, _ = tbl.Next(k) {
+		p := keyPath(path, k)
+		key := reflect.New(t.Key()).Elem()
+		if err := l.decode(k, key, p, depth+1); err != nil {
+			return err
+		}
+		elem := reflect.New(t.Elem()).Elem()
+		if err := l.decode(v, elem, p, depth+1); err != nil {
+			return err
+		}
+		rv.SetMapIndex(key, elem)
+	}
+	return nil
+}
+
+func (l *State) decodeStruct(tbl *table, rv reflect.Value, path string, depth int) error {
+	for _, f := range luaFields(rv.Type()) {
+		v := tbl.Get(f.name)
+		if v == nil {
+			continue
+		}
+		// Allocate the embedded pointers on the way to the field.
+		fv := rv
+		for _, i := range f.index {
+			if fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					fv.Set(reflect.New(fv.Type().Elem()))
+				}
+				fv = fv.Elem()
+			}
+			fv = fv.Field(i)
+		}
+		if err := l.decode(v, fv, fieldPath(path, f.name), depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeAny decodes tbl for an interface{}.
+func (l *State) decodeAny(tbl *table, path string, depth int) (interface{}, error) {
+	if n := tbl.Length(); n > 0 && n == tbl.Count() {
+		s := make([]interface{}, n)
+		return s, l.decodeSeq(tbl, reflect.ValueOf(s), path, depth)
+	}
+
+	strs := true
+	for k, _, _ := tbl.Next(nil); k != nil; k, _, _ = tbl.Next(k) {
+		if _, ok := k.(string); !ok {
+			strs = false
+			break
+		}
+	}
+	var m reflect.Value
+	if strs {
+		m = reflect.ValueOf(make(map[string]interface{}))
+	} else {
+		m = reflect.ValueOf(make(map[interface{}]interface{}))
+	}
+	return m.Interface(), l.decodeMap(tbl, m, path, depth)
+}
+
+// seenKey identifies the Go memory that a table was converted from.
+type seenKey struct {
+	p uintptr
+	t reflect.Type
+	n int
+}
+
+// encode converts rv into a Lua value.
+func (l *State) encode(rv reflect.Value, seen map[seenKey]*table) value {
+	if !rv.IsValid() {
+		return nil
+	}
+	switch rv.Kind() {
+	case reflect.Bool:
+		return rv.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return fromUint(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.String:
+		return rv.String()
+	case reflect.Interface:
+		return l.encode(rv.Elem(), seen)
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+		if rv.IsNil() {
+			return nil
+		}
+	}
+
+	switch x := rv.Interface().(type) {
+	case *table, *function, *userdata, *coroutine:
+		return x
+	case *Function:
+		return x.value()
+	}
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if k := rv.Elem().Kind(); k == reflect.Struct || k == reflect.Array {
+			return l.encodeTable(rv.Elem(), seenKey{rv.Pointer(), rv.Type(), 0}, seen)
+		}
+		return l.encode(rv.Elem(), seen)
+	case reflect.Map:
+		return l.encodeTable(rv, seenKey{rv.Pointer(), rv.Type(), 0}, seen)
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return string(rv.Bytes())
+		}
+		return l.encodeTable(rv, seenKey{rv.Pointer(), rv.Type(), rv.Len()}, seen)
+	case reflect.Struct, reflect.Array:
+		return l.encodeTable(rv, seenKey{}, seen)
+	}
+
+	l.pushGo(rv)
+	v := l.stack.Get(-1)
+	l.stack.Pop(1)
+	return v
+}
+
+// encodeTable converts the struct, array, slice or map rv into a table.
+// If key is not zero, the table is recorded in seen to convert the same memory to the same table.
+func (l *State) encodeTable(rv reflect.Value, key seenKey, seen map[seenKey]*table) *table {
+	if tbl, ok := seen[key]; ok && key.p != 0 {
+		return tbl
+	}
+
+	var tbl *table
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		tbl = newTable(l, rv.Len(), 0)
+	case reflect.Map:
+		tbl = newTable(l, 0, rv.Len())
+	default:
+		tbl = newTable(l, 0, rv.NumField())
+	}
+	if key.p != 0 {
+		seen[key] = tbl
+	}
+
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			tbl.Set(int64(i+1), l.encode(rv.Index(i), seen))
+		}
+	case reflect.Map:
+		iter := rv.MapRange()
+		for iter.Next() {
+			k := l.encode(iter.Key(), seen)
+			if f, ok := k.(float64); k == nil || ok && math.IsNaN(f) {
+				continue
+			}
+			tbl.Set(k, l.encode(iter.Value(), seen))
+		}
+	case reflect.Struct:
+		for _, f := range luaFields(rv.Type()) {
+			fv, err := rv.FieldByIndexErr(f.index)
+			if err != nil || f.omitempty && fv.IsZero() {
+				continue
+			}
+			tbl.Set(f.name, l.encode(fv, seen))
+		}
+	}
+	return tbl
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2019 by ofunc
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import (
+	"errors"
+)
+
+// ErrMemory is raised when a State allocates more memory than allowed by SetAllocLimit.
+var ErrMemory = errors.New("not enough memory")
+
+// Approximate sizes of the allocations, in bytes.
+const (
+	sizeTable = 96 // A table without any elements
+	sizeValue = 16 // An element in the array part of a table
+	sizeEntry = 48 // An element in the hash part of a table
+)
+
+// SetAllocLimit limits the memory that the State and all of its coroutines may allocate to about n bytes,
+// and resets the allocated memory like ResetAlloc.
+// The VM uses the Go collector and can't tell when memory is freed, so this is not a limit of the memory in use,
+// but a budget for the memory allocated by tables, string concatenation and the standard modules.
+// When the budget is exhausted ErrMemory is raised by every following allocation until it is reset.
+// Set n to 0 to remove the limit.
+func (l *State) SetAllocLimit(n int64) {
+	if n < 0 {
+		n = 0
+	}
+	l.allocLimit = n
+	l.allocated = 0
+}
+
+// AllocLimit returns the allocation limit of the State, or 0 if there is no limit.
+func (l *State) AllocLimit() int64 {
+	return l.allocLimit
+}
+
+// Allocated returns the memory allocated by the State since the budget was last reset.
+// Freed memory is not subtracted.
+func (l *State) Allocated() int64 {
+	return l.allocated
+}
+
+// ResetAlloc starts a new allocation budget, keeping the limit.
+// A long-running State should call it between its calls, for example before every top-level PCall,
+// so the budget applies to each call rather than to the whole life of the State.
+func (l *State) ResetAlloc() {
+	l.allocated = 0
+}
+
+// Alloc reports that native code allocates about n bytes on behalf of the State.
+// It should be called before the allocation, so ErrMemory is raised before a huge allocation is done.
+func (l *State) Alloc(n int64) {
+	l.alloc(n)
+}
+
+func (g *globalState) alloc(n int64) {
+	if g.allocLimit > 0 && (n > g.allocLimit || g.allocated > g.allocLimit-n) {
+		panic(ErrMemory)
+	}
+	g.allocated += n
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2019 by ofunc
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// Proto is a compiled Lua chunk.
+// It is immutable, so it can be shared by States, also by States in different goroutines.
+type Proto struct {
+	proto *funcProto
+}
+
+// Compile compiles the Lua source src, the name is used in error messages and tracebacks.
+// Use State.PushProto to get a function of the chunk.
+func Compile(src, name string) (*Proto, error) {
+	proto, err := compSource(src, name, 1)
+	if err != nil {
+		return nil, err
+	}
+	return &Proto{proto}, nil
+}
+
+// Name returns the name of the chunk.
+func (p *Proto) Name() string {
+	return p.proto.source
+}
+
+// PushProto pushes a new function of the chunk p onto the stack.
+// If there is an error it is returned and nothing is pushed.
+// Set env to 0 to use the default environment, or to the index of a table or of nil.
+func (l *State) PushProto(p *Proto, env int) error {
+	l.checkLock()
+	envv, err := l.env(env)
+	if err != nil {
+		return err
+	}
+	l.stack.Push(l.asFunc(p.proto, envv))
+	return nil
+}
+
+// Cache is a cache of compiled chunks, safe for concurrent use.
+// It keeps the last version of each chunk, by key.
+// If Max is not 0, it keeps at most Max chunks, the ones used least recently are removed first.
+type Cache struct {
+	Max int // The maximum number of chunks, no limit if it is 0
+
+	mu     sync.Mutex
+	protos map[string]*cacheEntry
+	clock  uint64
+}
+
+type cacheEntry struct {
+	modTime time.Time
+	hash    [sha256.Size]byte
+	proto   *Proto
+	used    uint64
+}
+
+// DefaultCache is the cache that require and util.Run use.
+var DefaultCache = &Cache{Max: 1024}
+
+// Get returns the compiled chunk name, it is GetKey(name, name, modTime, read).
+func (c *Cache) Get(name string, modTime time.Time, read func() ([]byte, error)) (*Proto, error) {
+	return c.GetKey(name, name, modTime, read)
+}
+
+// GetKey returns the compiled chunk name, cached by key.
+// Chunks with the same name from different places, like file systems, need different keys.
+// If the modification time of the chunk is known and the same as the one of the cached chunk,
+// the cached chunk is returned without reading the source.
+// Otherwise read is called to get the source, which is only compiled if it changed.
+func (c *Cache) GetKey(key, name string, modTime time.Time, read func() ([]byte, error)) (*Proto, error) {
+	c.mu.Lock()
+	e := c.protos[key]
+	if e != nil && !modTime.IsZero() && e.modTime.Equal(modTime) {
+		c.clock++
+		e.used = c.clock
+		c.mu.Unlock()
+		return e.proto, nil
+	}
+	c.mu.Unlock()
+
+	src, err := read()
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(src)
+	var proto *Proto
+	if e != nil && e.hash == hash {
+		proto = e.proto
+	} else if proto, err = Compile(string(src), name); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.protos == nil {
+		c.protos = make(map[string]*cacheEntry)
+	}
+	if _, ok := c.protos[key]; !ok && c.Max > 0 && len(c.protos) >= c.Max {
+		c.evict(len(c.protos) - c.Max + 1)
+	}
+	c.clock++
+	c.protos[key] = &cacheEntry{modTime: modTime, hash: hash, proto: proto, used: c.clock}
+	return proto, nil
+}
+
+// evict removes the n chunks used least recently.
+func (c *Cache) evict(n int) {
+	for ; n > 0; n-- {
+		var key string
+		var used uint64
+		for k, e := range c.protos {
+			if key == "" || e.used < used {
+				key, used = k, e.used
+			}
+		}
+		delete(c.protos, key)
+	}
+}
+
+// Remove removes the chunk with the key from the cache.
+func (c *Cache) Remove(key string) {
+	c.mu.Lock()
+	delete(c.protos, key)
+	c.mu.Unlock()
+}
+
+// Len returns the number of chunks in the cache.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.protos)
+}
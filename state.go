@@ -23,7 +23,11 @@ misrepresented as being the original software.
 package lua
 
 import (
+	"context"
 	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -36,21 +40,101 @@ const (
 )
 
 // State is the central arbitrator of all Lua operations.
+//
+// A thread has two States, the one that the host gets from NewState or NewThread, and the one that
+// native functions and hooks get, which is only used while the thread holds its lock, see thread.go.
 type State struct {
+	*threadState
+}
+
+// threadState is the part of a State that is shared by the two States of a thread or coroutine.
+type threadState struct {
 	// Add a native stack trace to errors that have attached stack traces.
 	NativeTrace bool
 
-	stack    *stack
+	*globalState
+
+	stack *stack
+
+	// Coroutine information, see coroutine.go.
+	status ThreadStatus
+	co     *coroutine
+	resume chan []value
+	yield  chan transfer
+	nny    int // The number of non-yieldable calls in the stack
+
+	// The lock, see thread.go.
+	locks int          // The number of times the host acquired the shared lock
+	owner atomic.Int64 // The goroutine that holds the lock, 0 if it is not held
+	host  *State       // The State of the host
+	inner *State       // The State of native functions and hooks
+}
+
+// newThreadState returns the host State of the thread t.
+func newThreadState(t *threadState) *State {
+	t.host = &State{t}
+	t.inner = &State{t}
+	return t.host
+}
+
+// globalState is the part of a State that is shared by all of its coroutines and threads.
+type globalState struct {
+	// The lock of the threads, see thread.go.
+	mu     sync.Mutex
+	shared atomic.Bool // Are there any threads?
+
 	registry *table
 	global   *table
 	meta     [nType]*table
+
+	// Execution limits, see limit.go.
+	ctx    context.Context
+	done   <-chan struct{}
+	limit  int64 // The instruction limit, 0 if there is no limit
+	steps  int64 // The number of instructions executed before the current period
+	period int64 // The number of instructions between two checks
+	count  int64 // The number of instructions left in the current period
+
+	// Debug hooks, see debug.go.
+	hook      Hook
+	hookMask  int
+	hookCount int64 // The number of instructions between two count hooks
+	hookLeft  int64 // The number of instructions left before the next count hook
+	hooking   bool  // Is a hook running?
+
+	truncDiv bool   // Round integer division and modulo towards zero, see SetTruncatedDivision.
+	loadMode string // The chunks the load function may load, see SetLoadMode.
+
+	// Coroutines, see coroutine.go.
+	coMu       sync.Mutex
+	coroutines map[*State]bool // The coroutines that may have a goroutine waiting to be resumed
+	states     atomic.Int32    // The number of host States, of the main thread and of the other threads
+	stopClose  func() bool     // Stops closing the coroutines when the context is done
+
+	// The meta tables of Go types, see gobind.go.
+	goTypes map[reflect.Type]*table
+
+	// Finalizers, see finalizer.go.
+	finMu      sync.Mutex
+	fin        []value // The values waiting for their __gc meta methods
+	finalizing bool
+
+	// Memory accounting, see memory.go.
+	allocLimit int64
+	allocated  int64
 }
 
 // NewState creates a new State, ready to use.
 func NewState() *State {
-	l := &State{
-		stack: newStack(),
-	}
+	l := newThreadState(&threadState{
+		globalState: &globalState{
+			ctx: context.Background(),
+		},
+		stack:  newStack(),
+		status: ThreadRunning,
+	})
+	l.track()
+	l.resetCount()
 
 	l.global = newTable(l, 0, 64)
 	l.global.Set("_G", l.global)
@@ -80,7 +164,7 @@ func (l *State) get(i int) value {
 }
 
 // Used to create the return values for the compiler API functions (nothing else!).
-func (l *State) asFunc(proto *funcProto, env *table) *function {
+func (l *State) asFunc(proto *funcProto, env value) *function {
 	up := make([]*upValue, len(proto.upVals))
 	for i := range up {
 		def := proto.upVals[i].makeUp()
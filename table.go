@@ -24,25 +24,39 @@ package lua
 
 import (
 	"math"
-	"reflect"
 )
 
 // table is the VM's table type.
 type table struct {
-	array []value
-	hash  map[value]value
-	base  int
-	nums  []int
-	meta  *table
+	array   []value
+	hash    map[value]int // The index of the keys of the hash part in entries
+	entries []entry       // The hash part, in the order of insertion
+	dead    int           // The number of removed entries
+	base    int
+	nums    []int
+	meta    *table
+	g       *globalState // The owner, for memory accounting
+
+	// Weak tables, see weak.go.
+	weak    int // The mode of the table
+	sweepAt int // The size of the hash part that triggers the next sweep
+}
+
+// entry is an entry of the hash part of a table.
+// A removed entry keeps a weak reference to its key, so a traversal can continue from the key, see Next.
+type entry struct {
+	k, v value
 }
 
 func newTable(l *State, as, hs int) *table {
-	t := new(table)
+	l.alloc(sizeTable + int64(as)*sizeValue + int64(hs)*sizeEntry)
+	t := &table{g: l.globalState}
 	if as > 0 {
 		t.array = make([]value, as)
 	}
 	if hs > 0 {
-		t.hash = make(map[value]value, hs)
+		t.hash = make(map[value]int, hs)
+		t.entries = make([]entry, 0, hs)
 	}
 	t.base = 1
 
@@ -58,16 +72,29 @@ func newTable(l *State, as, hs int) *table {
 
 // Length returns the raw table length as would be returned by the length operator.
 func (tbl *table) Length() int {
+	if tbl.weak != 0 {
+		tbl.sweep()
+	}
 	return tbl.count(0, len(tbl.nums))
 }
 
 // Count returns the raw table pairs number.
 func (tbl *table) Count() int {
-	return tbl.count(0, 1) + len(tbl.hash)
+	if tbl.weak != 0 {
+		tbl.sweep()
+	}
+	return tbl.count(0, 1) + len(tbl.entries) - tbl.dead
 }
 
 // Get reads the value at index k from the table without using any meta methods.
 func (tbl *table) Get(k value) value {
+	if tbl.weak != 0 {
+		return deref(tbl.get(tbl.weakKey(k)))
+	}
+	return tbl.get(k)
+}
+
+func (tbl *table) get(k value) value {
 	switch idx := k.(type) {
 	case int64:
 		if idx >= 1 && idx <= int64(len(tbl.array)) {
@@ -85,11 +112,25 @@ func (tbl *table) Get(k value) value {
 	case nil:
 		return nil
 	}
-	return tbl.hash[k]
+	if i, ok := tbl.hash[k]; ok {
+		return tbl.entries[i].v
+	}
+	return nil
 }
 
 // Set sets a key k in the table to the value v without using any meta methods.
 func (tbl *table) Set(k, v value) {
+	if tbl.weak != 0 {
+		tbl.set(tbl.weakKey(k), tbl.weakValue(v))
+		if len(tbl.entries) > tbl.sweepAt {
+			tbl.sweep()
+		}
+		return
+	}
+	tbl.set(k, v)
+}
+
+func (tbl *table) set(k, v value) {
 	switch idx := k.(type) {
 	case int64:
 		if idx >= 1 {
@@ -112,31 +153,141 @@ func (tbl *table) Set(k, v value) {
 	}
 
 	if v == nil {
-		delete(tbl.hash, k)
+		tbl.remove(k)
 	} else {
-		if tbl.hash == nil {
-			tbl.hash = make(map[value]value)
+		tbl.put(k, v)
+	}
+}
+
+// put sets the key k of the hash part to the non nil value v.
+// A removed key gets its entry back, a new key is added at the end.
+func (tbl *table) put(k, v value) {
+	if i, ok := tbl.hash[k]; ok {
+		if tbl.entries[i].v == nil {
+			tbl.dead--
+		}
+		tbl.entries[i].v = v
+		return
+	}
+	if tbl.dead > 0 {
+		if w := makeWeak(k); w != k {
+			if i, ok := tbl.hash[w]; ok {
+				delete(tbl.hash, w)
+				tbl.hash[k] = i
+				tbl.entries[i] = entry{k, v}
+				tbl.dead--
+				return
+			}
+		}
+		if tbl.dead > len(tbl.entries)/2 {
+			tbl.compact()
 		}
-		tbl.hash[k] = v
 	}
+	if tbl.hash == nil {
+		tbl.hash = make(map[value]int)
+	}
+	tbl.g.alloc(sizeEntry)
+	tbl.hash[k] = len(tbl.entries)
+	tbl.entries = append(tbl.entries, entry{k, v})
+}
+
+// remove removes the key k from the hash part.
+// The entry is kept with a weak reference to the key until the next compaction.
+func (tbl *table) remove(k value) {
+	i, ok := tbl.hash[k]
+	if !ok || tbl.entries[i].v == nil {
+		return
+	}
+	w := makeWeak(k)
+	delete(tbl.hash, k)
+	tbl.hash[w] = i
+	tbl.entries[i] = entry{k: w}
+	tbl.dead++
+}
+
+// compact drops the removed entries.
+func (tbl *table) compact() {
+	hash := make(map[value]int, len(tbl.entries)-tbl.dead)
+	n := 0
+	for _, e := range tbl.entries {
+		if e.v != nil {
+			hash[e.k] = n
+			tbl.entries[n] = e
+			n++
+		}
+	}
+	clear(tbl.entries[n:])
+	tbl.entries = tbl.entries[:n]
+	tbl.hash = hash
+	tbl.dead = 0
+}
+
+// Next returns the entry after key k, or the first entry if k is nil, like the next function.
+// At the end of the table it returns nil, nil. It returns false if k is not a key of the table.
+//
+// The array part is traversed first, then the hash part in the order of insertion, so any number of
+// traversals can run at the same time and nothing is copied. Assigning to existing fields during a traversal,
+// including setting them to nil, is allowed: a removed key keeps its place until a new key is added.
+// If a new key is added during a traversal it may or may not be visited, the following entries are visited
+// once, and continuing from a key that was removed in the meantime may fail.
+func (tbl *table) Next(k value) (value, value, bool) {
+	i := 0
+	switch x := k.(type) {
+	case nil:
+	case int64:
+		i = int(x)
+	case float64:
+		if n := int64(x); float64(n) == x {
+			k, i = n, int(n)
+		}
+	}
+	if k != nil && (i < 1 || i > len(tbl.array)) {
+		// k is in the hash part.
+		hk := tbl.weakKey(k)
+		p, ok := tbl.hash[hk]
+		if !ok && tbl.dead > 0 {
+			p, ok = tbl.hash[makeWeak(hk)]
+		}
+		if !ok {
+			return nil, nil, false
+		}
+		return tbl.nextHash(p + 1)
+	}
+
+	for ; i < len(tbl.array); i++ {
+		if v := deref(tbl.array[i]); v != nil {
+			return int64(i + 1), v, true
+		}
+	}
+	return tbl.nextHash(0)
+}
+
+func (tbl *table) nextHash(p int) (value, value, bool) {
+	for ; p < len(tbl.entries); p++ {
+		e := tbl.entries[p]
+		if v, k := deref(e.v), deref(e.k); v != nil && k != nil {
+			return k, v, true
+		}
+	}
+	return nil, nil, true
 }
 
 // GetIter returns the table iterator.
 func (tbl *table) GetIter() func() (value, value) {
-	array := tbl.array
-	hash := reflect.ValueOf(tbl.hash).MapRange()
-	i, n := 0, len(array)
+	i, p := 0, 0
 	return func() (value, value) {
-		for ; i < n; i++ {
-			if v := array[i]; v != nil {
+		for ; i < len(tbl.array); i++ {
+			if v := deref(tbl.array[i]); v != nil {
 				i++
 				return int64(i), v
 			}
 		}
-		if hash.Next() {
-			k := hash.Key().Interface()
-			v := hash.Value().Interface()
-			return k, v
+		for ; p < len(tbl.entries); p++ {
+			e := tbl.entries[p]
+			if v, k := deref(e.v), deref(e.k); v != nil && k != nil {
+				p++
+				return k, v
+			}
 		}
 		return nil, nil
 	}
@@ -156,25 +307,22 @@ func (tbl *table) seti(i int64, v value) {
 		}
 	} else {
 		var x value
-		if tbl.hash != nil {
-			x = tbl.hash[i]
+		if p, ok := tbl.hash[i]; ok {
+			x = tbl.entries[p].v
 		}
 		if x != v {
 			if v == nil {
 				tbl.nums[tbl.index(i)] -= 1
-				delete(tbl.hash, i)
+				tbl.remove(i)
 			} else if x == nil {
 				tbl.nums[tbl.index(i)] += 1
 				if tbl.extend(i) {
 					tbl.array[i-1] = v
 				} else {
-					if tbl.hash == nil {
-						tbl.hash = make(map[value]value)
-					}
-					tbl.hash[i] = v
+					tbl.put(i, v)
 				}
 			} else {
-				tbl.hash[i] = v
+				tbl.put(i, v)
 			}
 		}
 	}
@@ -201,16 +349,19 @@ func (tbl *table) extend(idx int64) bool {
 	array := make([]value, u)
 	copy(array, tbl.array)
 	tbl.array = array
-	for k, v := range tbl.hash {
-		if i, ok := k.(int64); ok && i >= 1 && i <= int64(u) {
-			array[i-1] = v
-			delete(tbl.hash, k)
+	for p, e := range tbl.entries {
+		if i, ok := e.k.(int64); ok && e.v != nil && i >= 1 && i <= int64(u) {
+			array[i-1] = e.v
+			delete(tbl.hash, e.k)
+			tbl.entries[p] = entry{}
+			tbl.dead++
 		}
 	}
 	nums := make([]int, len(tbl.nums)-m)
 	nums[0] = tbl.count(0, m+1)
 	copy(nums[1:], tbl.nums[1+m:])
 	tbl.nums = nums
+	tbl.g.alloc(int64(u) * sizeValue)
 	return true
 }
 
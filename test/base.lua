@@ -1,3 +1,6 @@
+local string = require 'string'
+local table = require 'table'
+
 local test = {}
 
 function test.print()
@@ -19,6 +22,32 @@ function test.error()
 	assert(x == true and y == 'ABC' and z == 123)
 end
 
+function test.xpcall()
+	local x, y, z = xpcall(function(a, b)
+		return a, b
+	end, error, 'A', 123)
+	assert(x == true and y == 'A' and z == 123)
+	assert(select('#', xpcall(function() end, error)) == 1)
+	local ok, msg = xpcall(error, function(m)
+		return 'handled: ' .. m
+	end, 'ERROR')
+	assert(ok == false and msg == 'handled: ERROR')
+	local ok, msg = xpcall(error, function(m)
+		error('AGAIN')
+	end, 'ERROR')
+	assert(ok == false and msg == 'AGAIN')
+	local ok, msg = xpcall(function()
+		return 1 + {}
+	end, type)
+	assert(ok == false and msg == 'string')
+	local t = {}
+	local ok, msg = xpcall(error, function(m)
+		return m
+	end, t)
+	assert(ok == false and msg == t)
+	assert(pcall(xpcall, error) == false)
+end
+
 function test.metatable()
 	local t1, t2 = {}, {}
 	local m1, m2 = {}, {__metatable = 'ABC'}
@@ -61,6 +90,99 @@ function test.pairs()
 	assert(k1 ~= k2 and k2 ~= k3 and k3 ~= k1)
 end
 
+function test.next()
+	assert(next({}) == nil)
+	assert(next({}, nil) == nil)
+	assert(not pcall(next, {}, 'x'))
+	assert(not pcall(next, 123))
+
+	local xs = {'A', 'B', k1 = 'C', k2 = 'D', [2.5] = 'E'}
+	local seen, n = {}, 0
+	local k, v = next(xs)
+	while k ~= nil do
+		assert(xs[k] == v and not seen[k])
+		seen[k], n = true, n + 1
+		k, v = next(xs, k)
+	end
+	assert(n == 5)
+
+	-- A traversal can continue from any key.
+	for k in pairs(xs) do
+		local n = 0
+		for _ in next, xs, k do
+			n = n + 1
+		end
+		assert(n < 5)
+	end
+	assert(next(xs, 2.0) ~= 2)
+end
+
+function test.next_nested()
+	local xs = {}
+	for i = 1, 50 do
+		xs['k' .. i] = i
+	end
+
+	-- All the traversals follow the same order, so every pair of keys is visited once.
+	local seen, n = {}, 0
+	for k1 in pairs(xs) do
+		for _ in pairs(xs) do
+			break
+		end
+		for k2 in next, xs, k1 do
+			local id = xs[k1] < xs[k2] and k1 .. k2 or k2 .. k1
+			assert(not seen[id])
+			seen[id], n = true, n + 1
+		end
+	end
+	assert(n == 50 * 49 / 2)
+
+	-- A removed key that is added again keeps its place.
+	local k, v = next(xs)
+	xs[k] = nil
+	xs[k] = v
+	assert(next(xs) == k)
+end
+
+function test.next_assign()
+	local xs = {}
+	for i = 1, 100 do
+		xs['k' .. i] = i
+		xs[i] = i
+	end
+
+	-- Existing fields can be changed or cleared during a traversal.
+	local n = 0
+	for k, v in pairs(xs) do
+		xs[k] = nil
+		n = n + 1
+	end
+	assert(n == 200 and next(xs) == nil)
+
+	for i = 1, 100 do
+		xs['k' .. i] = i
+	end
+	for k, v in pairs(xs) do
+		xs[k] = v * 2
+	end
+	for i = 1, 100 do
+		assert(xs['k' .. i] == i * 2)
+	end
+
+	-- Adding keys is undefined: entries may be visited again or skipped,
+	-- and continuing from a removed key fails, but the traversal ends.
+	local ok, msg = pcall(function()
+		local n = 0
+		for k in pairs(xs) do
+			xs[k] = nil
+			xs['new' .. n] = n
+			n = n + 1
+			assert(n < 10000)
+		end
+	end)
+	assert(ok or string.find(msg, "invalid key to 'next'", 1, true), msg)
+end
+
 function test.raw()
 	local xs = setmetatable({}, {
 		__index = error;
@@ -104,6 +226,8 @@ function test.tonumber()
 	assert(tonumber(nil) == nil)
 	assert(tonumber('ABC') == nil)
 	assert(tonumber('0xABC') == 2748)
+	assert(tonumber('0x1.8p3') == 12 and tonumber(' 0x.1 ') == 1/16 and tonumber('-0x1p-1') == -0.5)
+	assert(tonumber('0x1p') == nil and tonumber('0x.p1') == nil and tonumber('0x1_0p0') == nil)
 end
 
 function test.tostring()
@@ -143,4 +267,57 @@ function test.package()
 	assert(pkg1 == 123459)
 end
 
+function test.searchers()
+	local package = require 'package'
+	assert(package.loaded.package == package)
+	assert(package.loaded.string == require 'string')
+	assert(type(package.path) == 'string' and type(package.config) == 'string')
+	assert(package.searchpath('test.pkg', 'x/?.lua;?.lua;?.txt', '.', '/') == 'test/pkg.lua')
+	local p, msg = package.searchpath('test.none', 'x/?.lua;?.lua', '.', '/')
+	assert(p == nil and msg == "\n\tno file 'x/test/none.lua'\n\tno file 'test/none.lua'", msg)
+
+	local args
+	table.insert(package.searchers, function(name)
+		if name:sub(1, 4) == 'gen.' then
+			return function(...)
+				args = {...}
+				return name:sub(5)
+			end, 'data'
+		end
+		return '\n\tnot generated'
+	end)
+	assert(require 'gen.abc' == 'abc' and package.loaded['gen.abc'] == 'abc')
+	assert(args[1] == 'gen.abc' and args[2] == 'data')
+	package.preload['gen.pre'] = function() return 'preloaded' end
+	assert(require 'gen.pre' == 'preloaded')
+	package.loaded['gen.abc'] = nil
+	assert(require 'gen.abc' == 'abc' and #args == 2)
+
+	local ok, msg = pcall(require, 'none')
+	assert(not ok, msg)
+	assert(string.find(msg, "module 'none' not found:\n\tno field package.preload['none']", 1, true), msg)
+	assert(string.find(msg, "none.lua'", 1, true) and string.find(msg, '\n\tnot generated', 1, true), msg)
+	table.remove(package.searchers)
+end
+
+function test.args()
+	local ok, msg = pcall(function() local t = setmetatable(1, {}) end)
+	assert(not ok and string.find(msg, "bad argument #1 to 'setmetatable' (table expected, got number)", 1, true), msg)
+	ok, msg = pcall(function() local t = setmetatable({}, 1) end)
+	assert(not ok and string.find(msg, "(nil or table expected, got number)", 1, true), msg)
+	ok, msg = pcall(function() local x = select(0, 1) end)
+	assert(not ok and string.find(msg, "bad argument #1 to 'select' (index out of range)", 1, true), msg)
+	ok, msg = pcall(function() local x = rawlen(1) end)
+	assert(not ok and string.find(msg, "(table or string expected, got number)", 1, true), msg)
+	ok, msg = pcall(function() local x = type() end)
+	assert(not ok and string.find(msg, "bad argument #1 to 'type' (value expected)", 1, true), msg)
+	ok, msg = pcall(function() for k in pairs(nil) do end end)
+	assert(not ok and string.find(msg, "(table expected, got nil)", 1, true), msg)
+
+	local t = {}
+	ok, msg = pcall(assert, false, t)
+	assert(not ok and msg == t)
+	assert(select(3, 1) == nil)
+end
+
 return test
@@ -0,0 +1,157 @@
+local test = {}
+local coroutine = require 'coroutine'
+local string = require 'string'
+local table = require 'table'
+local io = require 'io'
+
+function test.resume()
+	local co = coroutine.create(function(a, b)
+		assert(a == 1 and b == 2)
+		local c, d = coroutine.yield(a + b)
+		assert(c == 'C' and d == nil)
+		local e = coroutine.yield()
+		return e, 'END'
+	end)
+	assert(type(co) == 'thread')
+	assert(coroutine.status(co) == 'suspended')
+	local ok, x = coroutine.resume(co, 1, 2)
+	assert(ok and x == 3)
+	local ok, x = coroutine.resume(co, 'C')
+	assert(ok and x == nil)
+	local ok, x, y = coroutine.resume(co, 'E')
+	assert(ok and x == 'E' and y == 'END')
+	assert(coroutine.status(co) == 'dead')
+	local ok, msg = coroutine.resume(co)
+	assert(not ok and msg == 'cannot resume dead coroutine')
+end
+
+function test.error()
+	local co = coroutine.create(function()
+		coroutine.yield()
+		error('ERROR')
+	end)
+	assert(coroutine.resume(co))
+	local ok, msg = coroutine.resume(co)
+	assert(not ok and msg == 'ERROR')
+	assert(coroutine.status(co) == 'dead')
+	assert(not pcall(coroutine.create, 123))
+	assert(not pcall(coroutine.yield))
+end
+
+function test.status()
+	local main = coroutine.running()
+	local co
+	co = coroutine.create(function()
+		assert(coroutine.status(co) == 'running')
+		assert(coroutine.status(main) == 'normal')
+		local self, ismain = coroutine.running()
+		assert(self == co and not ismain)
+		assert(coroutine.isyieldable())
+		local ok, msg = coroutine.resume(co)
+		assert(not ok and msg == 'cannot resume non-suspended coroutine')
+	end)
+	local self, ismain = coroutine.running()
+	assert(ismain and coroutine.status(self) == 'running')
+	assert(not coroutine.isyieldable())
+	assert(coroutine.resume(co))
+	assert(coroutine.status(co) == 'dead')
+end
+
+function test.wrap()
+	local gen = coroutine.wrap(function(n)
+		for i = 1, n do
+			coroutine.yield(i)
+		end
+	end)
+	assert(gen(3) == 1)
+	assert(gen() == 2)
+	assert(gen() == 3)
+	assert(gen() == nil)
+	assert(not pcall(gen))
+
+	local function range(n)
+		return coroutine.wrap(function()
+			for i = 1, n do
+				coroutine.yield(i)
+			end
+		end)
+	end
+	local sum = 0
+	for i in range(10) do
+		sum = sum + i
+	end
+	assert(sum == 55)
+	for i in range(10) do
+		break
+	end
+end
+
+function test.close()
+	local co = coroutine.create(function()
+		local self = coroutine.running()
+		coroutine.yield(self)
+	end)
+	local ok, self = coroutine.resume(co)
+	assert(ok and self == co)
+	assert(coroutine.close(co))
+	assert(coroutine.status(co) == 'dead')
+	assert(not coroutine.resume(co))
+	assert(coroutine.close(co))
+	assert(not pcall(coroutine.close, coroutine.running()))
+end
+
+function test.nested()
+	local inner = coroutine.wrap(function()
+		coroutine.yield('A')
+		coroutine.yield('B')
+	end)
+	local outer = coroutine.wrap(function()
+		coroutine.yield(inner())
+		coroutine.yield('X')
+		coroutine.yield(inner())
+	end)
+	assert(outer() == 'A')
+	assert(outer() == 'X')
+	assert(outer() == 'B')
+end
+
+function test.pcall()
+	local co = coroutine.create(function()
+		local ok, x = pcall(function()
+			local x = coroutine.yield('IN')
+			error(x)
+		end)
+		assert(not ok)
+		coroutine.yield(x)
+		return 'OUT'
+	end)
+	local _, x = coroutine.resume(co)
+	assert(x == 'IN')
+	local _, x = coroutine.resume(co, 'ERROR')
+	assert(x == 'ERROR')
+	local _, x = coroutine.resume(co)
+	assert(x == 'OUT')
+end
+
+function test.boundary()
+	local co = coroutine.create(function()
+		table.sort({3, 2, 1}, function(a, b)
+			coroutine.yield()
+			return a < b
+		end)
+	end)
+	local ok, msg = coroutine.resume(co)
+	assert(not ok and msg:find('yield across'))
+
+	local co = coroutine.create(function()
+		local scan = io.scanner(io.buffer('A B'), function(data, eof)
+			assert(not coroutine.isyieldable())
+			coroutine.yield()
+		end)
+		scan()
+	end)
+	local ok, msg = coroutine.resume(co)
+	assert(not ok and msg:find('yield across'))
+end
+
+return test
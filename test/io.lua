@@ -1,5 +1,7 @@
 local test = {}
 local io = require 'io'
+local os = require 'os'
+local string = require 'string'
 
 function test.stdio()
 	assert(io.stdin ~= nil)
@@ -10,4 +12,13 @@ function test.stdio()
 	assert(io.type(io.stderr) == 'readwriter')
 end
 
+function test.types()
+	assert(string.find(tostring(io.stdout), '^os%.File: '))
+	assert(getmetatable(io.stdout) == getmetatable(os.tmpfile()))
+	local ok, msg = pcall(function() local s = io.read(123) end)
+	assert(not ok and string.find(msg, "bad argument #1 to 'read' (reader expected, got number)", 1, true), msg)
+	ok, msg = pcall(function() io.stdout = 'x' end)
+	assert(not ok and string.find(msg, "(writer expected, got string)", 1, true), msg)
+end
+
 return test
@@ -1,5 +1,6 @@
 local test = {}
 local math = require 'math'
+local string = require 'string'
 
 local eps = 1e-8
 
@@ -92,6 +93,51 @@ function test.fmod()
 	assert(math.fmod(-5, -3) == -2)
 	assert(math.fmod(-6, -3) == 0)
 	assert(math.abs(math.fmod(math.pi, math.e)-0.42331082513075) <= eps)
+	assert(math.type(math.fmod(-5, 3)) == 'integer' and math.fmod(-5.5, 2) == -1.5)
+	assert(math.fmod(math.mininteger, -1) == 0 and math.fmod(1, math.huge) == 1)
+	local ok, msg = pcall(function() local x = math.fmod(1, 0) end)
+	assert(not ok and string.find(msg, "bad argument #2 to 'fmod' (zero)", 1, true), msg)
+	assert(math.fmod(1, 0.0) ~= math.fmod(1, 0.0))
+end
+
+function test.modulo()
+	assert((-1) % 5 == 4 and 1 % -5 == -4 and -6 % 3 == 0 and 7 % 3 == 1)
+	assert((-1.5) % 1 == 0.5 and 5.5 % -2 == -0.5 and -5 % math.huge == math.huge)
+	assert((-7) // 2 == -4 and 7 // -2 == -4 and math.type(7 // 2) == 'integer')
+	assert(7.5 // 2 == 3.0 and math.type(7.5 // 2) == 'float' and -7.5 // 2 == -4)
+	assert(math.mininteger // -1 == math.mininteger and math.mininteger % -1 == 0)
+	for _, a in ipairs({-7, 7, -2, 0}) do
+		for _, b in ipairs({3, -3, 1}) do
+			assert(a // b * b + a % b == a)
+		end
+	end
+	local ok, msg = pcall(function() local x = 1 % 0 end)
+	assert(not ok and string.find(msg, "attempt to perform 'n%%0'"), msg)
+	ok, msg = pcall(function() local x = 1 // 0 end)
+	assert(not ok and string.find(msg, "attempt to perform 'n//0'", 1, true), msg)
+end
+
+function test.tonumber()
+	-- Only the Lua spellings of numbers are accepted.
+	for _, s in ipairs({'inf', '-inf', 'nan', 'infinity', '1_000', '0b11', '0o17', '1e', '1e+', '.', '-.e1', '0x'}) do
+		assert(tonumber(s) == nil, s)
+	end
+	local ok = pcall(function() return 'nan' + 1 end)
+	assert(not ok)
+	assert(tonumber('+12') == 12 and tonumber(' -1.5e1 ') == -15 and tonumber('1.') == 1 and tonumber('.5') == 0.5)
+
+	-- Decimal and hexadecimal floats out of range are infinities or zeros.
+	assert(tonumber('1e400') == math.huge and tonumber('-1e400') == -math.huge)
+	assert(tonumber('0x1p2000') == math.huge and tonumber('-0x1p2000') == -math.huge)
+	assert(tonumber('1e-400') == 0 and tonumber('0x1p-2000') == 0)
+	assert(1e400 == math.huge and 0x1p2000 == math.huge)
+
+	-- Decimal integers out of range are floats, hexadecimal integers wrap around.
+	assert(tonumber('9223372036854775807') == math.maxinteger and tonumber('-9223372036854775808') == math.mininteger)
+	assert(math.type(tonumber('9223372036854775808')) == 'float' and tonumber('9223372036854775808') == 2^63)
+	assert(math.type(9223372036854775808) == 'float' and math.type(-9223372036854775808) == 'float')
+	assert(tonumber('0xffffffffffffffff') == -1 and tonumber('0x10000000000000001') == 1)
+	assert(0xffffffffffffffff == -1 and math.type(0x10000000000000000) == 'integer')
 end
 
 function test.log()
@@ -158,4 +204,13 @@ function test.normfuncs()
 	assert(math.abs(math.tan(123)-0.51792747158566) <= eps)
 end
 
+function test.args()
+	local ok, msg = pcall(function() local x = math.floor('x') end)
+	assert(not ok and string.find(msg, "bad argument #1 to 'floor' (number expected, got string)", 1, true), msg)
+	ok, msg = pcall(function() local x = math.random(2, 1) end)
+	assert(not ok and string.find(msg, "bad argument #2 to 'random' (interval is empty)", 1, true), msg)
+	ok, msg = pcall(function() local x = math.max() end)
+	assert(not ok and string.find(msg, "bad argument #1 to 'max' (number expected, got no value)", 1, true), msg)
+end
+
 return test
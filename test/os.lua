@@ -57,4 +57,33 @@ function test.tmpname()
 	assert(t1 ~= t2)
 end
 
+function test.types()
+	local f = os.tmpfile()
+	assert(string.find(tostring(f), '^os%.File: '))
+	assert(string.find(tostring(os.stat(f)), '^os%.FileInfo: '))
+	assert(string.find(tostring(os.time()), '^os%.Time: '))
+	assert(f:close())
+
+	local ok, msg = pcall(function() local s = os.date('%c', 'x') end)
+	assert(not ok and string.find(msg, "bad argument #2 to 'date' (os.Time expected, got string)", 1, true), msg)
+	ok, msg = pcall(function() local n = f.seek(os.time()) end)
+	assert(not ok and string.find(msg, "bad argument #1 to 'seek' (os.File expected, got os.Time)", 1, true), msg)
+	ok, msg = pcall(function() local info = os.stat(123) end)
+	assert(not ok and string.find(msg, "(string or os.File expected, got number)", 1, true), msg)
+end
+
+function test.args()
+	local f = os.tmpfile()
+	local ok, msg = pcall(function() local n = f:seek('x') end)
+	assert(not ok and string.find(msg, "bad argument #2 to 'seek' (invalid option 'x')", 1, true), msg)
+	assert(f:seek('end') == 0)
+	f:close()
+	ok, msg = pcall(function() local f = os.open(f, 'r') end)
+	assert(not ok and string.find(msg, "bad argument #1 to 'open' (string expected, got os.File)", 1, true), msg)
+	ok, msg = pcall(function() local f = os.open('x', 'q') end)
+	assert(not ok and string.find(msg, "bad argument #2 to 'open' (invalid mode 'q')", 1, true), msg)
+	ok, msg = pcall(function() local t = os.time({year = 2000}) end)
+	assert(not ok and string.find(msg, "field 'month' missing in date table", 1, true), msg)
+end
+
 return test
@@ -1,6 +1,7 @@
 local test = {}
 local string = require 'string'
 local os = require 'os'
+local math = require 'math'
 
 function test.bytechar()
 	local a = string.byte('ABC')
@@ -45,6 +46,13 @@ function test.format()
 	assert(string.format('%d', 0xf) == '15')
 	assert(string.format('%.2f', 3.1415926) == '3.14')
 	assert(string.format('%v\t%v\t%v', 1, 2, 3) == '1\t2\t3')
+	assert(string.format('%a', 12.0) == '0x1.8p+3' and string.format('%A', -0.5) == '-0X1P-1')
+	assert(string.format('%a %d %.1a', 1, 5, 1/3) == '0x1p+0 5 0x1.5p-2')
+	assert(string.format('[%10a][%-8a][%+a]', 1, 2, 0) == '[    0x1p+0][0x1p+1  ][+0x0p+0]')
+	assert(string.format('%a', 1/0) == 'inf' and string.format('%%a') == '%a')
+	for _, x in ipairs({math.pi, -1e300, 5e-324, 0.1}) do
+		assert(tonumber(string.format('%a', x)) == x)
+	end
 end
 
 function test.gmatch()
@@ -79,6 +87,64 @@ function test.match()
 	assert(string.match('a.b.c.txt', '.+%.(%w+)$') == 'txt')
 end
 
+function test.pack()
+	assert(string.pack('<i4', 1) == '\x01\x00\x00\x00')
+	assert(string.pack('>i4', 1) == '\x00\x00\x00\x01')
+	assert(string.pack('<i2', -2) == '\xfe\xff')
+	assert(string.pack('>I3', 0x010203) == '\x01\x02\x03')
+	assert(string.pack('b', -1) == '\xff' and string.pack('B', 255) == '\xff')
+	assert(string.pack('<i16', -1) == string.rep('\xff', 16))
+	assert(string.pack('<I9', 1) == '\x01' .. string.rep('\x00', 8))
+	assert(string.pack('z', 'abc') == 'abc\x00')
+	assert(string.pack('<s1', 'abc') == '\x03abc')
+	assert(string.pack('c5', 'abc') == 'abc\x00\x00')
+	assert(string.pack('<!4 b i4', 1, 2) == '\x01\x00\x00\x00\x02\x00\x00\x00')
+	assert(string.pack('<!4 b Xi4 x', 1) == '\x01\x00\x00\x00\x00')
+	assert(string.pack('<b i4', 1, 2) == '\x01\x02\x00\x00\x00')
+	assert(string.pack('>d', 1.5) == '\x3f\xf8\x00\x00\x00\x00\x00\x00')
+
+	assert(string.packsize('i4') == 4)
+	assert(string.packsize('!8 b d') == 16)
+	assert(string.packsize('b h l j T f d n c3 x') == 1 + 2 + 8 + 8 + 8 + 4 + 8 + 8 + 3 + 1)
+
+	local s = string.pack('<i4 d z s2 B', -100, 3.25, 'hello', 'world', 200)
+	local a, b, c, d, e, n = string.unpack('<i4 d z s2 B', s)
+	assert(a == -100 and math.type(a) == 'integer')
+	assert(b == 3.25 and c == 'hello' and d == 'world' and e == 200)
+	assert(n == #s + 1)
+	assert(string.unpack('f', string.pack('f', 0.5)) == 0.5)
+	assert(string.unpack('<i16', string.pack('<i16', math.mininteger)) == math.mininteger)
+	assert(string.unpack('>I2', '\x00\x01\x02\x03', 3) == 0x0203)
+	assert(select(2, string.unpack('>I2', '\x00\x01\x02\x03', -2)) == 5)
+	assert(string.unpack('<i3', '\xff\xff\xff') == -1)
+	assert(string.unpack('<I3', '\xff\xff\xff') == 0xffffff)
+	assert(select(2, string.unpack('!4 b Xi4', '\x01\x00\x00\x00')) == 5)
+
+	local function fails(msg, f, ...)
+		local ok, err = pcall(f, ...)
+		assert(not ok and string.find(err, msg, 1, true), err)
+	end
+	fails("#2 to '?' (integer overflow)", string.pack, 'i1', 128)
+	fails("#2 to '?' (unsigned overflow)", string.pack, 'I1', -1)
+	fails("#3 to '?' (string longer than given size)", string.pack, 'b c2', 1, 'abc')
+	fails("#2 to '?' (string length does not fit in given size)", string.pack, 's1', string.rep('x', 256))
+	fails("#2 to '?' (string contains zeros)", string.pack, 'z', 'a\x00b')
+	fails("#2 to '?' (number expected, got no value)", string.pack, 'd')
+	fails("invalid format option 'y'", string.pack, 'y')
+	fails("integral size (17) out of limits [1,16]", string.pack, 'i17', 1)
+	fails("missing size for format option 'c'", string.pack, 'c', '')
+	fails("(format asks for alignment not power of 2)", string.pack, '!4 i3', 1)
+	fails("(invalid next option for option 'X')", string.pack, 'X')
+	fails("(variable-length format)", string.packsize, 's')
+	fails("(data string too short)", string.unpack, 'i4', '\x00\x00')
+	fails("(data string too short)", string.unpack, 's1', '\x05abc')
+	fails("(unfinished string for format 'z')", string.unpack, 'z', 'abc')
+	fails("(initial position out of string)", string.unpack, 'b', 'abc', 5)
+	fails("9-byte integer does not fit into Lua Integer", string.unpack, '<i9', string.rep('\x00', 8) .. '\x01')
+	local ok, msg = pcall(function() local s = string.pack('i1', 128) end)
+	assert(not ok and string.find(msg, "bad argument #2 to 'pack' (integer overflow)", 1, true), msg)
+end
+
 function test.rep()
 	assert(string.rep('', 0) == '')
 	assert(string.rep('', -1) == '')
@@ -106,4 +172,18 @@ function test.upper()
 	assert(string.upper('aBc') == 'ABC')
 end
 
+function test.args()
+	local ok, msg = pcall(function() local s = string.sub('abc', {}) end)
+	assert(not ok and string.find(msg, "bad argument #2 to 'sub' (number expected, got table)", 1, true), msg)
+	ok, msg = pcall(function() local s = string.rep() end)
+	assert(not ok and string.find(msg, "bad argument #1 to 'rep' (string expected, got no value)", 1, true), msg)
+	ok, msg = pcall(function() local s = ('x'):sub(1.5) end)
+	assert(not ok and string.find(msg, "(number has no integer representation)", 1, true), msg)
+	ok, msg = pcall(function() local s = string.char(256) end)
+	assert(not ok and string.find(msg, "bad argument #1 to 'char' (value out of range)", 1, true), msg)
+	ok, msg = pcall(function() local s = string.gsub('x', 'x', true) end)
+	assert(not ok and string.find(msg, "(string/function/table expected, got boolean)", 1, true), msg)
+	assert(string.sub(123, '2') == '23' and string.len(10) == 2)
+end
+
 return test
@@ -1,5 +1,6 @@
 local test = {}
 local string = require 'string'
+local math = require 'math'
 
 function test.string()
 	assert(string.byte('\xc0') == 192)
@@ -68,4 +69,57 @@ function test.table()
 	assert(n == 11)
 end
 
+function test.number()
+	assert(0x1.8p3 == 12.0 and math.type(0x1.8p3) == 'float')
+	assert(0xA == 10 and math.type(0xA) == 'integer')
+	assert(0x.8 == 0.5 and 0x1P-2 == 0.25 and 0xA.8p0 == 10.5)
+end
+
+function test.folding()
+	-- The constant expressions are folded by the compiler, the ones with id are computed at runtime.
+	local function id(x) return x end
+	local function same(a, b)
+		assert(math.type(a) == math.type(b), tostring(a) .. ' ~= ' .. tostring(b))
+		assert(a == b or a ~= a and b ~= b, tostring(a) .. ' ~= ' .. tostring(b))
+	end
+	same(60 * 60 * 24, id(60) * id(60) * id(24))
+	same(9223372036854775807 + 1, id(9223372036854775807) + 1)
+	same(-9223372036854775807 - 2, -id(9223372036854775807) - 2)
+	same(-(-9223372036854775807 - 1), -(id(-9223372036854775807) - 1))
+	same(9223372036854775807 * 2, id(9223372036854775807) * 2)
+	same(2 ^ 53, id(2) ^ 53)
+	same(2 ^ 0.5, id(2) ^ 0.5)
+	same(1 / 2, id(1) / 2)
+	same(1 / 0, id(1) / 0)
+	same(-1 / 0, -id(1) / 0)
+	same(0 / 0, id(0) / 0)
+	same(1 / -0.0, 1 / -id(0.0))
+	same(3 - 3.0, id(3) - 3.0)
+	same(1.5 + 2, id(1.5) + 2)
+	same((2) * (3.0), id(2) * 3.0)
+	same(3 & 5, id(3) & 5)
+	same(3 | 5.0, id(3) | 5.0)
+	same(0xF0 ~ 0xFF, id(0xF0) ~ 0xFF)
+	same(1 << 63, id(1) << 63)
+	same(1 << 64, id(1) << 64)
+	same(1 >> -1, id(1) >> -1)
+	same(-1 >> 1, id(-1) >> 1)
+	same(~0, ~id(0))
+	same(~5.0, ~id(5.0))
+	same(7 // 2, id(7) // 2)
+	same(-7 % 3, id(-7) % 3)
+	same(7.5 % -2, id(7.5) % -2)
+	same('10' + 1, id('10') + 1)
+	same('a' .. 'b' .. 'c', id('a') .. 'b' .. 'c')
+	same(id('x') .. 'a' .. 'b', 'x' .. id('a') .. 'b')
+	same('n' .. 1, 'n' .. id(1))
+
+	local ok1, msg1 = pcall(function() return 1.5 & 1 end)
+	local ok2, msg2 = pcall(function() return id(1.5) & 1 end)
+	assert(not ok1 and not ok2 and msg1 == msg2, msg1)
+	ok1, msg1 = pcall(function() return 1 // 0 end)
+	ok2, msg2 = pcall(function() return id(1) // 0 end)
+	assert(not ok1 and not ok2 and msg1 == msg2, msg1)
+end
+
 return test
@@ -1,5 +1,6 @@
 local test = {}
 local table = require 'table'
+local string = require 'string'
 
 function test.concat()
 	assert(table.concat({}, '-') == '')
@@ -106,4 +107,19 @@ function test.unpack()
 	assert(b == 'B' and c == 'C')
 end
 
+function test.args()
+	local ok, msg = pcall(function() local s = table.concat({1, {}}) end)
+	assert(not ok and string.find(msg, "invalid value (at index 2) in table for 'concat'", 1, true), msg)
+	ok, msg = pcall(function() table.insert({}, 5, 1) end)
+	assert(not ok and string.find(msg, "bad argument #2 to 'insert' (position out of bounds)", 1, true), msg)
+	ok, msg = pcall(function() table.insert({}, 1, 2, 3) end)
+	assert(not ok and string.find(msg, "wrong number of arguments to 'insert'", 1, true), msg)
+	ok, msg = pcall(function() table.sort({}, 1) end)
+	assert(not ok and string.find(msg, "bad argument #2 to 'sort' (function expected, got number)", 1, true), msg)
+
+	local t = {3, 1, 2}
+	table.sort(t, nil)
+	assert(t[1] == 1 and t[3] == 3)
+end
+
 return test
@@ -0,0 +1,113 @@
+/*
+Copyright 2019 by ofunc
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import (
+	"bytes"
+	"errors"
+	"runtime"
+	"strconv"
+)
+
+// ErrNotLocked is raised when a State that shares its globals with other threads is used without holding their lock.
+var ErrNotLocked = errors.New("lua: shared state used without holding the lock")
+
+// NewThread creates a new State with its own stack, sharing the registry, the globals, the type meta tables,
+// the limits and the hooks with this State. Threads are meant to be used from different goroutines.
+//
+// All threads of a State share one lock, and Lua code of any of them runs only while its thread holds it,
+// so Lua code of different threads never runs in parallel. Call and the PCall functions acquire the lock
+// for the duration of the call. Other code that touches shared values, for example the table functions
+// or SetGlobal, must call Lock and Unlock itself, otherwise ErrNotLocked is raised.
+// The stack of a thread must only be used by the goroutine that holds the lock, the others wait in Lock.
+func (l *State) NewThread() *State {
+	l.Lock()
+	defer l.Unlock()
+
+	l.shared.Store(true)
+	th := newThreadState(&threadState{
+		NativeTrace: l.NativeTrace,
+		globalState: l.globalState,
+		stack:       newStack(),
+		status:      ThreadRunning,
+	})
+	th.track()
+	return th
+}
+
+// Lock acquires the lock shared by the State and all of its threads, see NewThread.
+// The lock is reentrant for the goroutine that holds it, every Lock must be paired with an Unlock.
+// If another goroutine holds the lock, Lock waits until it is released, also if it holds it through this State.
+//
+// Native functions and hooks run under the lock of the call that runs them, they get a State that doesn't lock again.
+// Code that acquires the lock and runs Lua code switches to that State, so nested calls don't need to find the goroutine.
+func (l *State) Lock() {
+	if l.resume != nil || l == l.inner {
+		// A coroutine runs under the lock of the thread that resumed it.
+		return
+	}
+	id := goid()
+	if l.owner.Load() == id {
+		l.locks++
+		return
+	}
+	l.mu.Lock()
+	l.owner.Store(id)
+	l.locks = 1
+}
+
+// Unlock releases the lock acquired by Lock.
+func (l *State) Unlock() {
+	if l.resume != nil || l == l.inner {
+		return
+	}
+	if l.locks == 0 {
+		panic(errors.New("lua: unlock of unlocked State"))
+	}
+	l.locks--
+	if l.locks == 0 {
+		l.owner.Store(0)
+		l.mu.Unlock()
+	}
+}
+
+// checkLock raises ErrNotLocked if the State has threads and the running goroutine doesn't hold their lock.
+func (l *State) checkLock() {
+	if l.resume == nil && l != l.inner && l.shared.Load() && l.owner.Load() != goid() {
+		panic(ErrNotLocked)
+	}
+}
+
+// goid returns the id of the running goroutine.
+func goid() int64 {
+	var buf [64]byte
+	b := bytes.TrimPrefix(buf[:runtime.Stack(buf[:], false)], []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i > 0 {
+		b = b[:i]
+	}
+	id, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		panic(errors.New("lua: can't find the id of the goroutine"))
+	}
+	return id
+}
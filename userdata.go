@@ -0,0 +1,96 @@
+/*
+Copyright 2019 by ofunc
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import (
+	"errors"
+	"strings"
+)
+
+// RegisterType creates the meta table of the userdata type name in the registry, or updates it if it exists.
+// Functions whose names start with "__" are set as meta methods, the others are methods found through __index.
+// An __index function replaces the method table. The meta table has a __name field set to name,
+// which is used by ToString and by error messages.
+func (l *State) RegisterType(name string, methods map[string]func(*State) int) {
+	l.checkLock()
+	m, ok := l.registry.Get(name).(*table)
+	if !ok {
+		m = newTable(l, 0, 4)
+		m.Set("__name", name)
+		m.Set("__index", newTable(l, 0, len(methods)))
+		l.registry.Set(name, m)
+	}
+	for k, f := range methods {
+		l.Push(f)
+		fn := l.stack.Get(-1)
+		l.stack.Pop(1)
+		if strings.HasPrefix(k, "__") {
+			m.Set(k, fn)
+		} else if idx, ok := m.Get("__index").(*table); ok {
+			idx.Set(k, fn)
+		}
+	}
+}
+
+// PushUserData pushes v as a userdata with the meta table of the type name, see RegisterType.
+// If the meta table has a __gc meta method, it is called when the userdata is collected, see RunFinalizers.
+// If the type is not registered this will raise an error.
+func (l *State) PushUserData(v interface{}, name string) {
+	l.checkLock()
+	m, ok := l.registry.Get(name).(*table)
+	if !ok {
+		panic(errors.New("unregistered userdata type: " + name))
+	}
+	u := &userdata{data: v, meta: m}
+	l.setFinalizer(u, m)
+	l.stack.Push(u)
+}
+
+// TestUserData returns the data of the userdata at the given index if it has the meta table of the type name.
+func (l *State) TestUserData(i int, name string) (interface{}, bool) {
+	if u, ok := l.get(i).(*userdata); ok && u.meta != nil && u.meta == l.registry.Get(name) {
+		return u.data, true
+	}
+	return nil, false
+}
+
+// CheckUserData returns the data of the userdata at the given index if it has the meta table of the type name,
+// otherwise it raises an error like "bad argument #1 to 'close' (os.File expected, got string)".
+func (l *State) CheckUserData(i int, name string) interface{} {
+	if v, ok := l.TestUserData(i, name); ok {
+		return v
+	}
+	l.TypeError(i, name)
+	return nil
+}
+
+// typeName returns the __name of the meta table of v, or the name of its type.
+func (l *State) typeName(v value) string {
+	switch v.(type) {
+	case *table, *userdata:
+		if name, ok := l.getMetaField(v, "__name").(string); ok {
+			return name
+		}
+	}
+	return typeOf(v).String()
+}
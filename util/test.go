@@ -68,7 +68,7 @@ func Test(l *lua.State, root string) error {
 					fmt.Println("     PASS")
 				} else {
 					fail += 1
-					fmt.Println("     FAIL:", msg)
+					fmt.Println("     FAIL:", msg.(*lua.Error).Traceback())
 				}
 				l.Push(nil)
 			}
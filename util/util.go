@@ -24,7 +24,9 @@ misrepresented as being the original software.
 package util
 
 import (
-	"fmt"
+	"io"
+	"io/fs"
+	"strings"
 
 	"github.com/ofunc/lua"
 	"github.com/ofunc/lua/lmodbase"
@@ -36,7 +38,20 @@ const (
 	Version = lmodbase.Version
 )
 
+// Options is the configuration of a State, see NewState.
+type Options struct {
+	Paths  []string  // The searchpaths for require, see lmodbase.SetPaths, the ones of lmodbase.Paths if it is nil
+	FS     []fs.FS   // The file systems for require and Run, see lmodbase.AddFS
+	Root   string    // The value of os.root, the directory of the executable if it is empty
+	Stdin  io.Reader // The standard files of the io module, the ones of the process if they are nil
+	Stdout io.Writer // Also the output of print
+	Stderr io.Writer
+	Policy *Policy // The buildin modules and what they may do, all of them without restrictions if it is nil
+}
+
 // The root path for the executable.
+//
+// Deprecated: Use lmodos.Root, or Options.Root to set the root of a State.
 var Root string
 
 func init() {
@@ -44,14 +59,43 @@ func init() {
 }
 
 // NewState creates a new State, opens the buildin modules, and disables undefined variables.
-func NewState() *lua.State {
+// The State is configured with the options, if there are any, at most one Options can be passed.
+// The options are kept by the State, so States with different options can run side by side.
+func NewState(opts ...Options) *lua.State {
+	var o Options
+	switch len(opts) {
+	case 0:
+	case 1:
+		o = opts[0]
+	default:
+		panic("util: NewState takes at most one Options")
+	}
 	l := lua.NewState()
 	Strict(l)
-	Open(l)
+	lmodos.SetOptions(l, lmodos.Options{
+		Root:   o.Root,
+		Stdin:  o.Stdin,
+		Stdout: o.Stdout,
+		Stderr: o.Stderr,
+	})
+	if o.Policy == nil {
+		Open(l)
+	} else {
+		OpenWith(l, *o.Policy)
+	}
+	if o.Paths != nil {
+		lmodbase.SetPaths(l, o.Paths)
+	}
+	lmodbase.SetOutput(l, o.Stdout)
+	for _, fsys := range o.FS {
+		lmodbase.AddFS(l, fsys)
+	}
 	return l
 }
 
-// AddPath adds the searchpath for "require".
+// AddPath adds the searchpath for "require", to the package.path of the States opened later.
+//
+// Deprecated: Use Options.Paths to set the searchpaths of a State.
 func AddPath(path string) {
 	lmodbase.Paths = append(lmodbase.Paths, path)
 }
@@ -68,18 +112,101 @@ func Strict(l *lua.State) {
 	l.SetMetaTable(lua.GlobalsIndex)
 }
 
-// Run runs the specified Lua src file.
-func Run(l *lua.State, src string) error {
-	r, err := lmodbase.OpenSrc(src)
-	if err != nil {
-		return err
+type module struct {
+	name string
+	open func(*lua.State) int
+}
+
+// Policy selects the buildin modules and functions of a State, and what they may do, see OpenWith.
+type Policy struct {
+	Modules []string      // The modules that can be required, including "package", nil for all of them
+	Disable []string      // The functions to remove, like "print" or "os.tmpname"
+	Load    string        // The chunks that load may load, see lua.State.SetLoadMode
+	OS      lmodos.Policy // What the os and io modules may do
+}
+
+// Sandbox is a policy for untrusted scripts.
+// They can't use files, run programs, exit, read the environment or load chunks.
+var Sandbox = Policy{
+	Modules: []string{"coroutine", "string", "utf8", "table", "math", "os"},
+}
+
+// Open opens the buildin modules.
+func Open(l *lua.State) {
+	OpenWith(l, Policy{OS: lmodos.Unrestricted})
+}
+
+// OpenWith opens the buildin modules that the policy p selects, and restricts them to it.
+// The restrictions are enforced by the modules themselves,
+// so scripts can't get around them with functions or handles they got in other ways.
+func OpenWith(l *lua.State, p Policy) {
+	lmodos.SetPolicy(l, p.OS)
+	l.SetLoadMode(p.Load)
+	l.Push(lmodbase.Open)
+	l.Call(0, 0)
+	if p.Modules != nil && !contains(p.Modules, "package") {
+		// Scripts can't change where require looks for modules.
+		l.Push("_LOADED")
+		l.GetTableRaw(lua.RegistryIndex)
+		l.Push("package")
+		l.Push(nil)
+		l.SetTableRaw(-3)
+		l.Pop(1)
+	}
+
+	for _, m := range modules {
+		if p.Modules == nil || contains(p.Modules, m.name) {
+			l.Preload(m.name, without(m.open, m.name, p.Disable))
+		}
+	}
+	for _, name := range p.Disable {
+		if !strings.Contains(name, ".") {
+			l.Push(name)
+			l.Push(nil)
+			l.SetTableRaw(lua.GlobalsIndex)
+		}
+	}
+}
+
+// without wraps the open function of the module name, to remove the disabled functions of the module.
+func without(open func(*lua.State) int, name string, disable []string) func(*lua.State) int {
+	var fields []string
+	for _, x := range disable {
+		if strings.HasPrefix(x, name+".") {
+			fields = append(fields, x[len(name)+1:])
+		}
+	}
+	if len(fields) == 0 {
+		return open
 	}
-	defer r.Close()
-	if err := l.LoadText(r, src, 0); err != nil {
+	return func(l *lua.State) int {
+		n := open(l)
+		for _, f := range fields {
+			l.Push(f)
+			l.Push(nil)
+			l.SetTableRaw(-3)
+		}
+		return n
+	}
+}
+
+func contains(xs []string, x string) bool {
+	for _, y := range xs {
+		if x == y {
+			return true
+		}
+	}
+	return false
+}
+
+// Run runs the specified Lua src file, see lmodbase.LoadSrc for how it is found and compiled.
+// Errors raised by the script are returned as *lua.Error.
+func Run(l *lua.State, src string) error {
+	if err := lmodbase.LoadSrc(l, src); err != nil {
 		return err
 	}
 	if msg := l.PCall(0, 0, true); msg != nil {
-		return fmt.Errorf("%v", msg)
+		return msg.(*lua.Error)
 	}
 	return nil
 }
@@ -25,8 +25,7 @@ misrepresented as being the original software.
 package util
 
 import (
-	"github.com/ofunc/lua"
-	"github.com/ofunc/lua/lmodbase"
+	"github.com/ofunc/lua/lmodcoroutine"
 	"github.com/ofunc/lua/lmodio"
 	"github.com/ofunc/lua/lmodmath"
 	"github.com/ofunc/lua/lmodos"
@@ -35,15 +34,13 @@ import (
 	"github.com/ofunc/lua/lmodutf8"
 )
 
-// Open opens the buildin modules.
-func Open(l *lua.State) {
-	l.Push(lmodbase.Open)
-	l.Call(0, 0)
-
-	l.Preload("string", lmodstring.Open)
-	l.Preload("utf8", lmodutf8.Open)
-	l.Preload("table", lmodtable.Open)
-	l.Preload("math", lmodmath.Open)
-	l.Preload("io", lmodio.Open)
-	l.Preload("os", lmodos.Open)
+// The buildin modules besides the base module.
+var modules = []module{
+	{"coroutine", lmodcoroutine.Open},
+	{"string", lmodstring.Open},
+	{"utf8", lmodutf8.Open},
+	{"table", lmodtable.Open},
+	{"math", lmodmath.Open},
+	{"io", lmodio.Open},
+	{"os", lmodos.Open},
 }
@@ -25,8 +25,7 @@ misrepresented as being the original software.
 package util
 
 import (
-	"github.com/ofunc/lua"
-	"github.com/ofunc/lua/lmodbase"
+	"github.com/ofunc/lua/lmodcoroutine"
 	"github.com/ofunc/lua/lmodio"
 	"github.com/ofunc/lua/lmodjs"
 	"github.com/ofunc/lua/lmodmath"
@@ -36,16 +35,14 @@ import (
 	"github.com/ofunc/lua/lmodutf8"
 )
 
-// Open opens the buildin modules.
-func Open(l *lua.State) {
-	l.Push(lmodbase.Open)
-	l.Call(0, 0)
-
-	l.Preload("string", lmodstring.Open)
-	l.Preload("utf8", lmodutf8.Open)
-	l.Preload("table", lmodtable.Open)
-	l.Preload("math", lmodmath.Open)
-	l.Preload("io", lmodio.Open)
-	l.Preload("os", lmodos.Open)
-	l.Preload("js", lmodjs.Open)
+// The buildin modules besides the base module.
+var modules = []module{
+	{"coroutine", lmodcoroutine.Open},
+	{"string", lmodstring.Open},
+	{"utf8", lmodutf8.Open},
+	{"table", lmodtable.Open},
+	{"math", lmodmath.Open},
+	{"io", lmodio.Open},
+	{"os", lmodos.Open},
+	{"js", lmodjs.Open},
 }
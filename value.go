@@ -28,7 +28,8 @@ import (
 	"math"
 	"reflect"
 	"strconv"
-	"strings"
+
+	"github.com/ofunc/lua/ast"
 )
 
 type TypeID int
@@ -43,6 +44,7 @@ const (
 	TypeTable
 	TypeFunction
 	TypeUserData
+	TypeThread
 
 	nType int = iota
 )
@@ -53,7 +55,7 @@ const (
 	STypeFloat
 )
 
-var typeNames = []string{"unknown", "nil", "number", "string", "boolean", "table", "function", "userdata"}
+var typeNames = []string{"unknown", "nil", "number", "string", "boolean", "table", "function", "userdata", "thread"}
 var stypeNames = []string{"unknown", "integer", "float"}
 
 func (typ TypeID) String() string {
@@ -87,6 +89,8 @@ func typeOf(v value) TypeID {
 		return TypeFunction
 	case *userdata:
 		return TypeUserData
+	case *coroutine:
+		return TypeThread
 	default:
 		return TypeUnknown
 	}
@@ -127,10 +131,15 @@ func toString(v value) string {
 	case nil:
 		return "nil"
 	default:
-		return typeOf(x).String() + ": " + strconv.FormatUint(uint64(reflect.ValueOf(x).Pointer()), 16)
+		return typeOf(x).String() + ": " + pointerString(x)
 	}
 }
 
+// pointerString formats the address of a table, function, userdata or coroutine.
+func pointerString(v value) string {
+	return strconv.FormatUint(uint64(reflect.ValueOf(v).Pointer()), 16)
+}
+
 func tryFloat(v value) (float64, error) {
 	switch x := v.(type) {
 	case float64:
@@ -138,7 +147,10 @@ func tryFloat(v value) (float64, error) {
 	case int64:
 		return float64(x), nil
 	case string:
-		return strconv.ParseFloat(strings.TrimSpace(x), 64)
+		if valid, _, _, f := ast.ConvNumber(x, false, true); valid {
+			return f, nil
+		}
+		return 0, errors.New("can't convert to float: " + x)
 	default:
 		return 0, errors.New("can't convert to float: " + toString(x))
 	}
@@ -164,19 +176,17 @@ func tryInteger(v value) (int64, error) {
 			return 0, errors.New("can't convert to integer: " + toString(x))
 		}
 	case string:
-		x = strings.TrimSpace(x)
-		if y, err := strconv.ParseInt(x, 0, 64); err == nil {
+		valid, iok, y, f := ast.ConvNumber(x, true, true)
+		if !valid {
+			return 0, errors.New("can't convert to integer: " + x)
+		}
+		if iok {
 			return y, nil
-		} else if y, err := strconv.ParseFloat(x, 64); err == nil {
-			z := int64(y)
-			if float64(z) == y {
-				return z, nil
-			} else {
-				return 0, errors.New("can't convert to integer: " + x)
-			}
-		} else {
-			return 0, err
 		}
+		if y = int64(f); float64(y) != f {
+			return 0, errors.New("can't convert to integer: " + x)
+		}
+		return y, nil
 	default:
 		return 0, errors.New("can't convert to integer: " + toString(x))
 	}
@@ -304,155 +314,227 @@ func (l *State) tryMathMeta(op opCode, a, b value) value {
 	return rtn
 }
 
+// SetTruncatedDivision selects how the State, its coroutines and its threads round integer division and modulo.
+// By default // and % round towards minus infinity, like Lua 5.3 does, so (-1) % 5 is 4.
+// Older versions rounded towards zero, like Go does, so (-1) % 5 was -1 and // only accepted integers.
+// Set on to true to keep that behavior for code that relies on it.
+func (l *State) SetTruncatedDivision(on bool) {
+	l.truncDiv = on
+}
+
+// divInt is the integer floor division.
+func divInt(a, b int64) int64 {
+	if b == 0 {
+		panic("attempt to perform 'n//0'")
+	}
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// modInt is the integer floor modulo, the result has the sign of b.
+func modInt(a, b int64) int64 {
+	if b == 0 {
+		panic("attempt to perform 'n%0'")
+	}
+	r := a % b
+	if r != 0 && (r^b) < 0 {
+		r += b
+	}
+	return r
+}
+
+// modFloat is the float floor modulo, like luai_nummod in the reference implementation.
+func modFloat(a, b float64) float64 {
+	m := math.Mod(a, b)
+	if m != 0 && (m < 0) != (b < 0) {
+		m += b
+	}
+	return m
+}
+
 func (l *State) arith(op opCode, a, b value) value {
+	if v, ok := arithRaw(op, a, b, l.truncDiv); ok {
+		return v
+	}
+	return l.tryMathMeta(op, a, b)
+}
+
+// arithRaw performs the arithmetic operation op on numbers, and on strings that can be converted to numbers.
+// It returns false if the operands are not suitable, so the meta methods are tried.
+// The compiler uses it to fold constants, so it must not depend on the State.
+func arithRaw(op opCode, a, b value, truncDiv bool) (value, bool) {
 	switch op {
 	case OpAdd:
 		ia, oka := a.(int64)
 		ib, okb := b.(int64)
 		if oka && okb {
-			return ia + ib
+			return ia + ib, true
 		}
 
 		fa, erra := tryFloat(a)
 		fb, errb := tryFloat(b)
 		if erra == nil && errb == nil {
-			return fa + fb
+			return fa + fb, true
 		}
 
-		return l.tryMathMeta(op, a, b)
+		return nil, false
 	case OpSub:
 		ia, oka := a.(int64)
 		ib, okb := b.(int64)
 		if oka && okb {
-			return ia - ib
+			return ia - ib, true
 		}
 
 		fa, erra := tryFloat(a)
 		fb, errb := tryFloat(b)
 		if erra == nil && errb == nil {
-			return fa - fb
+			return fa - fb, true
 		}
 
-		return l.tryMathMeta(op, a, b)
+		return nil, false
 	case OpMul:
 		ia, oka := a.(int64)
 		ib, okb := b.(int64)
 		if oka && okb {
-			return ia * ib
+			return ia * ib, true
 		}
 
 		fa, erra := tryFloat(a)
 		fb, errb := tryFloat(b)
 		if erra == nil && errb == nil {
-			return fa * fb
+			return fa * fb, true
 		}
 
-		return l.tryMathMeta(op, a, b)
+		return nil, false
 	case OpMod:
 		ia, oka := a.(int64)
 		ib, okb := b.(int64)
 		if oka && okb {
-			return ia % ib
+			if truncDiv {
+				return ia % ib, true
+			}
+			return modInt(ia, ib), true
 		}
 
 		fa, erra := tryFloat(a)
 		fb, errb := tryFloat(b)
 		if erra == nil && errb == nil {
-			return math.Mod(fa, fb)
+			if truncDiv {
+				return math.Mod(fa, fb), true
+			}
+			return modFloat(fa, fb), true
 		}
 
-		return l.tryMathMeta(op, a, b)
+		return nil, false
 	case OpPow:
 		fa, erra := tryFloat(a)
 		fb, errb := tryFloat(b)
 		if erra == nil && errb == nil {
-			return math.Pow(fa, fb)
+			return math.Pow(fa, fb), true
 		}
 
-		return l.tryMathMeta(op, a, b)
+		return nil, false
 	case OpDiv:
 		fa, erra := tryFloat(a)
 		fb, errb := tryFloat(b)
 		if erra == nil && errb == nil {
-			return fa / fb
+			return fa / fb, true
 		}
 
-		return l.tryMathMeta(op, a, b)
+		return nil, false
 	case OpIDiv:
 		ia, erra := tryInteger(a)
 		ib, errb := tryInteger(b)
+		if truncDiv {
+			if erra == nil && errb == nil {
+				return ia / ib, true
+			}
+			return nil, false
+		}
+
+		_, fla := a.(float64)
+		_, flb := b.(float64)
+		if erra == nil && errb == nil && !fla && !flb {
+			return divInt(ia, ib), true
+		}
+
+		fa, erra := tryFloat(a)
+		fb, errb := tryFloat(b)
 		if erra == nil && errb == nil {
-			return ia / ib
+			return math.Floor(fa / fb), true
 		}
 
-		return l.tryMathMeta(op, a, b)
+		return nil, false
 	case OpBinAND:
 		ia, erra := tryInteger(a)
 		ib, errb := tryInteger(b)
 		if erra == nil && errb == nil {
-			return ia & ib
+			return ia & ib, true
 		}
 
-		return l.tryMathMeta(op, a, b)
+		return nil, false
 	case OpBinOR:
 		ia, erra := tryInteger(a)
 		ib, errb := tryInteger(b)
 		if erra == nil && errb == nil {
-			return ia | ib
+			return ia | ib, true
 		}
 
-		return l.tryMathMeta(op, a, b)
+		return nil, false
 	case OpBinXOR:
 		ia, erra := tryInteger(a)
 		ib, errb := tryInteger(b)
 		if erra == nil && errb == nil {
-			return ia ^ ib
+			return ia ^ ib, true
 		}
 
-		return l.tryMathMeta(op, a, b)
+		return nil, false
 	case OpBinShiftL:
 		ia, erra := tryInteger(a)
 		ib, errb := tryInteger(b)
 		if erra == nil && errb == nil {
 			if ib < 0 {
-				return int64(uint64(ia) >> uint64(-ib))
+				return int64(uint64(ia) >> uint64(-ib)), true
 			} else {
-				return int64(uint64(ia) << uint64(ib))
+				return int64(uint64(ia) << uint64(ib)), true
 			}
 		}
 
-		return l.tryMathMeta(op, a, b)
+		return nil, false
 	case OpBinShiftR:
 		ia, erra := tryInteger(a)
 		ib, errb := tryInteger(b)
 		if erra == nil && errb == nil {
 			if ib < 0 {
-				return int64(uint64(ia) << uint64(-ib))
+				return int64(uint64(ia) << uint64(-ib)), true
 			} else {
-				return int64(uint64(ia) >> uint64(ib))
+				return int64(uint64(ia) >> uint64(ib)), true
 			}
 		}
 
-		return l.tryMathMeta(op, a, b)
+		return nil, false
 	case OpUMinus:
 		ia, oka := a.(int64)
 		if oka {
-			return -ia
+			return -ia, true
 		}
 
 		fa, erra := tryFloat(a)
 		if erra == nil {
-			return -fa
+			return -fa, true
 		}
 
-		return l.tryMathMeta(op, a, b)
+		return nil, false
 	case OpBinNot:
 		ia, erra := tryInteger(a)
 		if erra == nil {
-			return ^ia
+			return ^ia, true
 		}
 
-		return l.tryMathMeta(op, a, b)
+		return nil, false
 	default:
 		panic("Invalid opCode passed to arith")
 		panic("UNREACHABLE")
@@ -608,6 +690,9 @@ func toStringConcat(v value) string {
 	case *userdata:
 		panic("Attempt to concatenate a userdata value.")
 		panic("UNREACHABLE")
+	case *coroutine:
+		panic("Attempt to concatenate a thread value.")
+		panic("UNREACHABLE")
 	default:
 		panic("Invalid type passed to toStringConcat.")
 		panic("UNREACHABLE")
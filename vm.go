@@ -44,11 +44,20 @@ func (l *State) call(fi, args, rtns int, tail bool) {
 
 			if tail {
 				l.stack.TailFrame(f, fi, args+1)
+				if l.hookMask&MaskCall != 0 {
+					l.callHook(HookCall)
+				}
 				l.exec()
 				return
 			}
 			l.stack.AddFrame(f, fi, args+1, rtns)
+			if l.hookMask&MaskCall != 0 {
+				l.callHook(HookCall)
+			}
 			l.exec()
+			if l.hookMask&MaskReturn != 0 {
+				l.callHook(HookReturn)
+			}
 			l.stack.ReturnFrame()
 			return
 		}
@@ -57,11 +66,20 @@ func (l *State) call(fi, args, rtns int, tail bool) {
 
 	if tail {
 		l.stack.TailFrame(f, fi, args)
+		if l.hookMask&MaskCall != 0 {
+			l.callHook(HookCall)
+		}
 		l.exec()
 		return
 	}
 	l.stack.AddFrame(f, fi, args, rtns)
+	if l.hookMask&MaskCall != 0 {
+		l.callHook(HookCall)
+	}
 	l.exec()
+	if l.hookMask&MaskReturn != 0 {
+		l.callHook(HookReturn)
+	}
 	l.stack.ReturnFrame()
 	return
 }
@@ -69,11 +87,16 @@ func (l *State) call(fi, args, rtns int, tail bool) {
 func (l *State) exec() {
 	if l.stack.cFrame().fn.native != nil {
 		fr := l.stack.cFrame()
-		fr.retC = fr.fn.native(l)
+		l.nny++
+		fr.retC = fr.fn.native(l.inner)
+		l.nny--
 		fr.retBase = l.stack.TopIndex() + 1 - fr.retC
 	} else {
 		i, ok := l.stack.cFrame().nxtOp()
 		for ok {
+			if l.count--; l.count <= 0 {
+				l.checkLimits()
+			}
 			//l.Printf("[%v]\t%v\n", l.stack.cFrame().pc-1, i)
 			_ = "breakpoint"                           // Next Instruction
 			if instructionTable[i.getOpCode()](l, i) { // RETURN and TAILCALL return true
@@ -298,6 +321,7 @@ func init() {
 
 				k++
 				if k > c {
+					l.alloc(int64(buff.Len()))
 					l.stack.Set(i.a(), buff.String())
 					return false
 				}
@@ -309,7 +333,9 @@ func init() {
 			var sa, sb value
 			concat := func() {
 				if t1, t2 := typeOf(sa), typeOf(sb); (t1 == TypeString || t1 == TypeNumber) && (t2 == TypeString || t2 == TypeNumber) {
-					sb = toStringConcat(sa) + toStringConcat(sb)
+					x, y := toStringConcat(sa), toStringConcat(sb)
+					l.alloc(int64(len(x) + len(y)))
+					sb = x + y
 					return
 				}
 
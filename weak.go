@@ -0,0 +1,153 @@
+/*
+Copyright 2019 by ofunc
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package lua
+
+import (
+	"strings"
+	"weak"
+)
+
+// Modes of weak tables, from the __mode field of their meta table.
+const (
+	weakKeys = 1 << iota
+	weakValues
+)
+
+// The minimum size of the hash part before dead entries are swept on insertion.
+const minSweep = 64
+
+// weakRef is a weak reference stored in a weak table instead of a collectable value.
+// Strings, numbers and booleans are never collected, so they are stored as they are.
+type weakRef interface {
+	get() value
+}
+
+type weakPointer[T any] struct {
+	p weak.Pointer[T]
+}
+
+func (w weakPointer[T]) get() value {
+	if p := w.p.Value(); p != nil {
+		return p
+	}
+	return nil
+}
+
+func makeWeak(v value) value {
+	switch x := v.(type) {
+	case *table:
+		return weakPointer[table]{weak.Make(x)}
+	case *function:
+		return weakPointer[function]{weak.Make(x)}
+	case *userdata:
+		return weakPointer[userdata]{weak.Make(x)}
+	case *coroutine:
+		return weakPointer[coroutine]{weak.Make(x)}
+	default:
+		return v
+	}
+}
+
+// deref returns the value of a weak reference, or nil if it was collected. Other values are returned as they are.
+func deref(v value) value {
+	if w, ok := v.(weakRef); ok {
+		return w.get()
+	}
+	return v
+}
+
+// weakKey converts k to the key used in the hash part.
+func (tbl *table) weakKey(k value) value {
+	if tbl.weak&weakKeys != 0 {
+		return makeWeak(k)
+	}
+	return k
+}
+
+// weakValue converts v to the value stored in the table.
+func (tbl *table) weakValue(v value) value {
+	if tbl.weak&weakValues != 0 {
+		return makeWeak(v)
+	}
+	return v
+}
+
+// setMeta sets the meta table of the table and applies its __mode.
+// Like the reference implementation, changing __mode after the meta table is set has no effect.
+func (tbl *table) setMeta(m *table) {
+	tbl.meta = m
+	mode := 0
+	if m != nil {
+		if s, ok := m.Get("__mode").(string); ok {
+			if strings.Contains(s, "k") {
+				mode |= weakKeys
+			}
+			if strings.Contains(s, "v") {
+				mode |= weakValues
+			}
+		}
+	}
+	if mode == tbl.weak {
+		return
+	}
+
+	// Dead entries are kept as they are, so sweep keeps the length right.
+	tbl.weak = mode
+	for i, v := range tbl.array {
+		if x := deref(v); x != nil {
+			tbl.array[i] = tbl.weakValue(x)
+		}
+	}
+	tbl.compact()
+	for i, e := range tbl.entries {
+		if x, y := deref(e.k), deref(e.v); x != nil && y != nil {
+			delete(tbl.hash, e.k)
+			e = entry{tbl.weakKey(x), tbl.weakValue(y)}
+			tbl.hash[e.k] = i
+			tbl.entries[i] = e
+		}
+	}
+	tbl.sweep()
+}
+
+// sweep removes the entries whose key or value was collected.
+func (tbl *table) sweep() {
+	for i, v := range tbl.array {
+		if v != nil && deref(v) == nil {
+			tbl.array[i] = nil
+			tbl.nums[0] -= 1
+		}
+	}
+	for _, e := range tbl.entries {
+		if e.v != nil && (deref(e.k) == nil || deref(e.v) == nil) {
+			tbl.remove(e.k)
+			if i, ok := e.k.(int64); ok && i >= 1 {
+				tbl.nums[tbl.index(i)] -= 1
+			}
+		}
+	}
+	tbl.sweepAt = 2 * (len(tbl.entries) - tbl.dead)
+	if tbl.sweepAt < minSweep {
+		tbl.sweepAt = minSweep
+	}
+}